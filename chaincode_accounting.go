@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Double-entry accounts behind the balances
+// - SYSTEM:Cash is the money collected by the machines, it mirrors Total_Balance
+// - SYSTEM:Equity is the counterpart of the initial Total_Balance
+// - <company>:RevenueShare is the unsettled share of the sales and eSIM usage earned by a company
+// - <company>:Receivable is what a company owes, from negative adjustments
+// - <company>:Payable is what is owed to a company from its settlement statements
+//
+// The Balance of a company is RevenueShare minus Receivable, its Settled balance is Payable.
+//
+// Accounts are stored under Account##<account> and journal entries under
+// Journal##<time>##<ledgerTxId>##<kind>##<reference>.
+const CASH_ACCOUNT string = "SYSTEM:Cash"
+const EQUITY_ACCOUNT string = "SYSTEM:Equity"
+
+// Rounding tolerance when comparing debits and credits
+const ACCOUNTING_EPSILON float64 = 1e-6
+
+// Account holds the debit and credit totals of an account
+type Account struct {
+	Account string  `json:"account"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+}
+
+// JournalLine debits or credits one account
+type JournalLine struct {
+	Account string  `json:"account"`
+	Debit   float64 `json:"debit,omitempty"`
+	Credit  float64 `json:"credit,omitempty"`
+}
+
+// JournalEntry is a balanced set of journal lines
+type JournalEntry struct {
+	Kind      string        `json:"kind"`
+	Reference string        `json:"reference"`
+	TxId      string        `json:"txId"`
+	Time      string        `json:"time"`
+	Lines     []JournalLine `json:"lines"`
+}
+
+// companyAccount is the name of an account of a company
+func companyAccount(companyName string, accountType string) string {
+	return companyName + ":" + accountType
+}
+
+// transfer debits an account and credits another one, swapping them for negative amounts
+func transfer(debitAccount string, creditAccount string, amount float64) []JournalLine {
+	if amount < 0 {
+		debitAccount, creditAccount, amount = creditAccount, debitAccount, -amount
+	}
+	return []JournalLine{
+		{Account: debitAccount, Debit: amount},
+		{Account: creditAccount, Credit: amount},
+	}
+}
+
+// +--------------------------------------------------------------------------+
+// | postJournalEntry - store a journal entry and update the account totals   |
+// +--------------------------------------------------------------------------+
+// The entry is rejected when its debits do not equal its credits.
+func postJournalEntry(stub shim.ChaincodeStubInterface, kind string, reference string, lines []JournalLine) error {
+	var entry JournalEntry
+	var debits, credits float64
+
+	for _, line := range lines {
+		if line.Debit < 0 || line.Credit < 0 {
+			return errorf(ERR_INTERNAL, "Invalid journal line for %s: negative amount", line.Account)
+		}
+		debits = debits + line.Debit
+		credits = credits + line.Credit
+	}
+	if math.Abs(debits-credits) > ACCOUNTING_EPSILON {
+		return errorf(ERR_INTERNAL, "Unbalanced %s journal entry for %s: debits %s, credits %s", kind, reference,
+			strconv.FormatFloat(debits, 'f', -1, 64), strconv.FormatFloat(credits, 'f', -1, 64))
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return err
+	}
+	entry.Kind = kind
+	entry.Reference = reference
+	entry.TxId = stub.GetTxID()
+	entry.Time = formatTime(now)
+	entry.Lines = lines
+
+	// Lines are summed by account first, an account can appear in several lines
+	var accountNames []string
+	totals := make(map[string]*JournalLine)
+	for _, line := range lines {
+		if line.Debit == 0 && line.Credit == 0 {
+			continue
+		}
+		total, ok := totals[line.Account]
+		if !ok {
+			total = &JournalLine{Account: line.Account}
+			totals[line.Account] = total
+			accountNames = append(accountNames, line.Account)
+		}
+		total.Debit = total.Debit + line.Debit
+		total.Credit = total.Credit + line.Credit
+	}
+	sort.Strings(accountNames)
+
+	for _, accountName := range accountNames {
+		line := totals[accountName]
+		account, err := readAccount(stub, line.Account)
+		if err != nil {
+			return err
+		}
+		account.Debit = account.Debit + line.Debit
+		account.Credit = account.Credit + line.Credit
+		accountBytes, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+		err = putState(stub, "Account"+SEPARATOR+line.Account, accountBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	key := "Journal" + SEPARATOR + entry.Time + SEPARATOR + entry.TxId + SEPARATOR + kind + SEPARATOR + reference
+	err = putState(stub, key, entryBytes)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// +------------------------------------------------------------+
+// | readAccount - read an account, missing accounts are empty  |
+// +------------------------------------------------------------+
+func readAccount(stub shim.ChaincodeStubInterface, accountName string) (Account, error) {
+	var account Account
+
+	accountBytes, err := stub.GetState("Account" + SEPARATOR + accountName)
+	if err != nil {
+		return account, errorf(ERR_LEDGER, "Failed to get state for account %s: %s", accountName, err)
+	}
+	if len(accountBytes) == 0 {
+		account.Account = accountName
+		return account, nil
+	}
+	if err = json.Unmarshal(accountBytes, &account); err != nil {
+		return account, errorf(ERR_CORRUPTED_STATE, "Corrupted account %s: %s", accountName, err)
+	}
+	return account, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | getTrialBalance - query function to list the accounts and their totals   |
+// +--------------------------------------------------------------------------+
+// balanced is true when the debits of all the accounts equal their credits.
+func (t *SimpleChaincode) getTrialBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var trialBalance struct {
+		Accounts    []Account `json:"accounts"`
+		TotalDebit  float64   `json:"totalDebit"`
+		TotalCredit float64   `json:"totalCredit"`
+		Balanced    bool      `json:"balanced"`
+	}
+
+	if len(args) != 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 0")
+	}
+
+	prefix := "Account" + SEPARATOR
+	iter, err := stub.RangeQueryState(prefix, prefix+"}")
+	if err != nil {
+		return nil, errorf(ERR_LEDGER, "getTrialBalance RangeQueryState failed: %s", err)
+	}
+	defer iter.Close()
+
+	var keys []string
+	accounts := make(map[string]Account)
+	for iter.HasNext() {
+		var account Account
+
+		ledgerKey, accountBytes, err := iter.Next()
+		if err != nil {
+			return nil, errorf(ERR_LEDGER, "getTrialBalance iter.Next() failed: %s", err)
+		}
+		if err = json.Unmarshal(accountBytes, &account); err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted account %s: %s", ledgerKey, err)
+		}
+		keys = append(keys, ledgerKey)
+		accounts[ledgerKey] = account
+	}
+	sort.Strings(keys)
+
+	trialBalance.Accounts = []Account{}
+	for _, key := range keys {
+		account := accounts[key]
+		trialBalance.Accounts = append(trialBalance.Accounts, account)
+		trialBalance.TotalDebit = trialBalance.TotalDebit + account.Debit
+		trialBalance.TotalCredit = trialBalance.TotalCredit + account.Credit
+	}
+	trialBalance.Balanced = math.Abs(trialBalance.TotalDebit-trialBalance.TotalCredit) <= ACCOUNTING_EPSILON
+
+	return json.Marshal(trialBalance)
+}
+
+// +------------------------------------------------------------------------------+
+// | getJournal - query function to list the journal entries in time order        |
+// | Params - optional pageSize=, bookmark=                                       |
+// +------------------------------------------------------------------------------+
+func (t *SimpleChaincode) getJournal(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	filters, err = parseFilters(args, "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err = queryPage(stub, "Journal"+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getJournal failed", err)
+	}
+
+	return json.Marshal(page)
+}
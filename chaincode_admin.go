@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Role of the callers allowed to use the debug queries, read from the "role"
+// attribute of the transaction certificate
+const ADMIN_ROLE string = "admin"
+
+// Key namespaces the read query can return, the part of the key before the
+// first separator. Indexes are left out, they only duplicate these records.
+var READABLE_NAMESPACES = []string{
+	COMPANY_NAMESPACE,
+	PRODUCT_NAMESPACE,
+	"Products",
+	ESIM_NAMESPACE,
+	MACHINE_NAMESPACE,
+	"Transactions",
+	"Total_Balance",
+	"Account",
+	"Journal",
+	"Settlements",
+}
+
+// Attributes never returned by the read query, whatever their namespace
+var UNREADABLE_ATTRIBUTES = []string{
+	"IoTSecretSalt",
+	"IoTSecretHash",
+}
+
+// +----------------------------------------------------------------------+
+// | checkAdmin - fail unless the caller certificate has the admin role   |
+// +----------------------------------------------------------------------+
+// The caller name returned is its enrollment id, when the certificate has one.
+func checkAdmin(stub shim.ChaincodeStubInterface, function string) (string, error) {
+	role, err := stub.ReadCertAttribute("role")
+	if err != nil {
+		return "", newError(ERR_UNAUTHORIZED, function+" is restricted to the "+ADMIN_ROLE+" role: "+err.Error())
+	}
+	if string(role) != ADMIN_ROLE {
+		return "", newError(ERR_UNAUTHORIZED, function+" is restricted to the "+ADMIN_ROLE+" role")
+	}
+
+	return callerName(stub, ADMIN_ROLE), nil
+}
+
+// +----------------------------------------------------------------------+
+// | callerName - enrollment id of the caller, for the audit trails       |
+// +----------------------------------------------------------------------+
+// defaultName is returned when the certificate has no enrollmentId attribute.
+func callerName(stub shim.ChaincodeStubInterface, defaultName string) string {
+	caller, err := stub.ReadCertAttribute("enrollmentId")
+	if err != nil || len(caller) == 0 {
+		return defaultName
+	}
+	return string(caller)
+}
+
+// +----------------------------------------------------------------+
+// | isReadableKey - check a key against the readable namespaces    |
+// +----------------------------------------------------------------+
+func isReadableKey(key string) bool {
+	parts := strings.Split(key, SEPARATOR)
+	for _, attribute := range UNREADABLE_ATTRIBUTES {
+		if parts[len(parts)-1] == attribute {
+			return false
+		}
+	}
+	for _, namespace := range READABLE_NAMESPACES {
+		if parts[0] == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// +------------------------------------------------------------------+
+// | read - debug query function to read a key/value pair             |
+// | Params - key                                                     |
+// +------------------------------------------------------------------+
+// Only callers with the admin role can read, and only the keys of the
+// readable namespaces. Every read, granted or denied, is written to the
+// chaincode log of the peer, and that log is the only trail of raw reads:
+// queries are not committed, so a query cannot raise an event or store an
+// audit record on the ledger.
+func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var key string
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting name of the key to query")
+	}
+
+	key = args[0]
+	caller, err := checkAdmin(stub, "read")
+	if err != nil {
+		fmt.Println("read denied for key " + key + ": " + err.Error())
+		return nil, err
+	}
+	if !isReadableKey(key) {
+		fmt.Println("read denied for key " + key + " to " + caller + ": namespace not readable")
+		return nil, newError(ERR_UNAUTHORIZED, "Key "+key+" is not readable. Readable namespaces are "+strings.Join(READABLE_NAMESPACES, ", "))
+	}
+	fmt.Println("read of key " + key + " by " + caller)
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ledgerError("get", key, err)
+	}
+
+	return valAsbytes, nil
+}
+
+// +----------------------------------------------------------------------+
+// | callerCompany - company of the caller, for the two-party approvals   |
+// +----------------------------------------------------------------------+
+// Read from the "company" attribute of the transaction certificate
+func callerCompany(stub shim.ChaincodeStubInterface) (string, error) {
+	company, err := stub.ReadCertAttribute("company")
+	if err != nil {
+		return "", errorf(ERR_UNAUTHORIZED, "Failed to read the company of the caller: %s", err)
+	}
+	if len(company) == 0 {
+		return "", newError(ERR_UNAUTHORIZED, "The caller certificate has no company attribute")
+	}
+	return string(company), nil
+}
+
+// +----------------------------------------------------------------------+
+// | checkCompanyCaller - fail unless the caller is the company or admin  |
+// +----------------------------------------------------------------------+
+func checkCompanyCaller(stub shim.ChaincodeStubInterface, companyName string, function string) error {
+	role, err := stub.ReadCertAttribute("role")
+	if err == nil && string(role) == ADMIN_ROLE {
+		return nil
+	}
+
+	caller, err := callerCompany(stub)
+	if err != nil {
+		return err
+	}
+	if caller != companyName {
+		return newError(ERR_UNAUTHORIZED, function+" is restricted to "+companyName+" and the "+ADMIN_ROLE+" role", "companyName", companyName)
+	}
+	return nil
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// +------------------------------------------------------------+
+// | parseAmount - parse an amount, balance or percentage       |
+// +------------------------------------------------------------+
+// NaN and infinite values are rejected, they cannot be stored as JSON
+func parseAmount(kind string, value string) (float64, error) {
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, newError(ERR_INVALID_ARGS, "Invalid "+kind+" "+value+": "+err.Error())
+	}
+	if math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, newError(ERR_INVALID_ARGS, "Invalid "+kind+" "+value+". Expecting a finite number")
+	}
+	return amount, nil
+}
+
+// +------------------------------------------------------------+
+// | readBalance - read a balance key, missing keys are zero    |
+// +------------------------------------------------------------+
+func readBalance(stub shim.ChaincodeStubInterface, key string) (float64, error) {
+	valueBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, ledgerError("get", key, err)
+	}
+	if len(valueBytes) == 0 {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(string(valueBytes), 64)
+	if err != nil {
+		return 0, errorf(ERR_CORRUPTED_STATE, "Corrupted balance %s: %s", key, err)
+	}
+	return value, nil
+}
+
+// +------------------------------------------------------------+
+// | addToBalance - add a signed amount to a balance key        |
+// +------------------------------------------------------------+
+// Returns the new balance
+func addToBalance(stub shim.ChaincodeStubInterface, key string, delta float64) (float64, error) {
+	value, err := readBalance(stub, key)
+	if err != nil {
+		return 0, err
+	}
+
+	value = value + delta
+	err = putState(stub, key, []byte(strconv.FormatFloat(value, 'f', -1, 64)))
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// Reason codes accepted by adjustBalance
+var ADJUSTMENT_REASONS = []string{"CORRECTION", "REFUND", "CHARGEBACK", "FEE", "WRITE_OFF", "OPENING_BALANCE"}
+
+// BalanceAdjustment is the record stored under Adjustments##<company>##<time>##<adjustmentId>
+type BalanceAdjustment struct {
+	AdjustmentId string  `json:"adjustmentId"`
+	CompanyName  string  `json:"companyName"`
+	Delta        float64 `json:"delta"`
+	ReasonCode   string  `json:"reasonCode"`
+	Actor        string  `json:"actor"`
+	Reference    string  `json:"reference"`
+	Time         string  `json:"time"`
+	BalanceAfter float64 `json:"balanceAfter"`
+}
+
+// +-----------------------------------------------------------------------+
+// | adjustBalance - invoke function to adjust the balance of a company    |
+// | Params - companyName, delta, reasonCode, reference                    |
+// +-----------------------------------------------------------------------+
+// The signed delta is added to the company balance and to Total_Balance, and
+// the adjustment is stored so that balances can be replayed from the sales
+// and the adjustments. Restricted to the admin role, the actor of the
+// adjustment is the enrollment id of the caller.
+func (t *SimpleChaincode) adjustBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyName, reasonCode, actor, reference string
+	var delta float64
+	var err error
+
+	fmt.Println("running adjustBalance()")
+
+	actor, err = checkAdmin(stub, "adjustBalance")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 4 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 4. Company name, delta, reason code and reference")
+	}
+
+	companyName = args[0]
+	delta, err = parseAmount("delta", args[1])
+	if err != nil {
+		return nil, err
+	}
+	if delta == 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid delta 0. An adjustment must change the balance")
+	}
+	reasonCode = strings.ToUpper(strings.TrimSpace(args[2]))
+	reference = strings.TrimSpace(args[3])
+
+	// Opening balances are only recorded when the company is added
+	if reasonCode == "OPENING_BALANCE" || !isAdjustmentReason(reasonCode) {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid reason code "+args[2]+". Expecting one of CORRECTION, REFUND, CHARGEBACK, FEE, WRITE_OFF")
+	}
+	if reference == "" {
+		return nil, newError(ERR_INVALID_ARGS, "Missing reference document of the adjustment")
+	}
+
+	balanceBytes, err := stub.GetState(companyKey(companyName, "Balance"))
+	if err != nil {
+		return nil, ledgerError("get", companyKey(companyName, "Balance"), err)
+	}
+	if len(balanceBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown company "+companyName, "companyName", companyName)
+	}
+
+	err = recordAdjustment(stub, companyName, delta, reasonCode, actor, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_BALANCE_ADJUSTED, BalanceAdjustment{AdjustmentId: stub.GetTxID(), CompanyName: companyName, Delta: delta, ReasonCode: reasonCode, Actor: actor, Reference: reference})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// +------------------------------------------------------------------------+
+// | recordAdjustment - apply a balance adjustment and store its record     |
+// +------------------------------------------------------------------------+
+func recordAdjustment(stub shim.ChaincodeStubInterface, companyName string, delta float64, reasonCode string, actor string, reference string) error {
+	var adjustment BalanceAdjustment
+	var err error
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return err
+	}
+
+	adjustment.AdjustmentId = stub.GetTxID()
+	adjustment.CompanyName = companyName
+	adjustment.Delta = delta
+	adjustment.ReasonCode = reasonCode
+	adjustment.Actor = actor
+	adjustment.Reference = reference
+	adjustment.Time = formatTime(now)
+
+	adjustment.BalanceAfter, err = changeBalance(stub, companyName, delta, "Adjustment", adjustment.AdjustmentId)
+	if err != nil {
+		return err
+	}
+	_, err = addToBalance(stub, "Total_Balance", delta)
+	if err != nil {
+		return err
+	}
+
+	// Credits go to the revenue share, debits to what the company owes
+	lines := transfer(CASH_ACCOUNT, companyAccount(companyName, "RevenueShare"), delta)
+	if delta < 0 {
+		lines = transfer(companyAccount(companyName, "Receivable"), CASH_ACCOUNT, -delta)
+	}
+	err = postJournalEntry(stub, "Adjustment", companyName, lines)
+	if err != nil {
+		return err
+	}
+
+	adjustmentBytes, err := json.Marshal(adjustment)
+	if err != nil {
+		return err
+	}
+	key := "Adjustments" + SEPARATOR + companyName + SEPARATOR + adjustment.Time + SEPARATOR + adjustment.AdjustmentId
+	err = putState(stub, key, adjustmentBytes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("recordAdjustment stored = " + string(adjustmentBytes))
+	return nil
+}
+
+// isAdjustmentReason checks a reason code against ADJUSTMENT_REASONS
+func isAdjustmentReason(reasonCode string) bool {
+	for _, reason := range ADJUSTMENT_REASONS {
+		if reason == reasonCode {
+			return true
+		}
+	}
+	return false
+}
+
+// +------------------------------------------------------------------------------+
+// | getBalanceAdjustments - query function to list the adjustments of a company  |
+// | Params - companyName, optional pageSize=, bookmark=                          |
+// +------------------------------------------------------------------------------+
+func (t *SimpleChaincode) getBalanceAdjustments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyName string
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting name of the company, followed by optional pageSize= and bookmark=")
+	}
+
+	companyName = args[0]
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Adjustments are listed by time
+	page, err = queryPage(stub, "Adjustments"+SEPARATOR+companyName+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getBalanceAdjustments failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// +-----------------------------------------------------------------------------+
+// | openBalance - create the balance of a new company with its opening balance  |
+// +-----------------------------------------------------------------------------+
+// The opening balance goes through recordAdjustment so that it is part of the
+// replayable history and of Total_Balance. Only admins can open a company with
+// a balance other than zero, they are the actor of the opening adjustment.
+func openBalance(stub shim.ChaincodeStubInterface, companyName string, initialBalance float64, function string) error {
+	var actor string
+	var err error
+
+	if initialBalance != 0 {
+		actor, err = checkAdmin(stub, function+" with an initial balance")
+		if err != nil {
+			return err
+		}
+	}
+
+	balanceBytes, err := stub.GetState(companyKey(companyName, "Balance"))
+	if err != nil {
+		return ledgerError("get", companyKey(companyName, "Balance"), err)
+	}
+	if len(balanceBytes) > 0 {
+		return newError(ERR_CONFLICT, "Company "+companyName+" already exists. Use adjustBalance to change its balance")
+	}
+
+	err = putState(stub, companyKey(companyName, "Balance"), []byte("0"))
+	if err != nil {
+		return err
+	}
+	if initialBalance == 0 {
+		return nil
+	}
+	return recordAdjustment(stub, companyName, initialBalance, "OPENING_BALANCE", actor, stub.GetTxID())
+}
+
+// CompanyReconciliation compares the balances of a company with the balances
+// recomputed from its sales, refunds, adjustments and settlement statements
+type CompanyReconciliation struct {
+	CompanyName            string  `json:"companyName"`
+	Role                   string  `json:"role"`
+	Balance                float64 `json:"balance"`
+	ExpectedBalance        float64 `json:"expectedBalance"`
+	BalanceDiscrepancy     float64 `json:"balanceDiscrepancy"`
+	SettledBalance         float64 `json:"settledBalance"`
+	ExpectedSettledBalance float64 `json:"expectedSettledBalance"`
+	SettledDiscrepancy     float64 `json:"settledDiscrepancy"`
+	Reconciled             bool    `json:"reconciled"`
+}
+
+// Reconciliation is the report returned by reconcile
+type Reconciliation struct {
+	Companies              []CompanyReconciliation `json:"companies"`
+	TotalBalance           float64                 `json:"totalBalance"`
+	ExpectedTotalBalance   float64                 `json:"expectedTotalBalance"`
+	TotalDiscrepancy       float64                 `json:"totalDiscrepancy"`
+	CompanyBalancesSum     float64                 `json:"companyBalancesSum"`
+	OpeningBalance         float64                 `json:"openingBalance"`
+	UnverifiedTransactions []string                `json:"unverifiedTransactions"`
+	Reconciled             bool                    `json:"reconciled"`
+}
+
+// +-------------------------------------------------------------------------------+
+// | reconcile - query function to check the balances against the ledger records   |
+// +-------------------------------------------------------------------------------+
+// Expected balances are replayed from the Transactions##, Refunds##, Adjustments##,
+// ESIMUsage## and Settlements## records. Transactions recorded before the shares
+// were stored cannot be split between the companies, they are listed as
+// unverified and only count in the expected Total_Balance.
+// Total_Balance must equal the opening balance given to Init plus the balances
+// and settled balances of all the companies.
+func (t *SimpleChaincode) reconcile(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var report Reconciliation
+	var err error
+
+	fmt.Println("running reconcile()")
+
+	if len(args) != 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 0")
+	}
+
+	expected := make(map[string]*CompanyReconciliation)
+	company := func(companyName string) *CompanyReconciliation {
+		reconciliation, ok := expected[companyName]
+		if !ok {
+			reconciliation = &CompanyReconciliation{CompanyName: companyName}
+			expected[companyName] = reconciliation
+		}
+		return reconciliation
+	}
+
+	// Registered companies are reported even without any record
+	err = scanPrefix(stub, "Companies"+SEPARATOR, func(key string, value []byte) error {
+		var registered Company
+		if err := json.Unmarshal(value, &registered); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted company %s: %s", key, err)
+		}
+		company(registered.CompanyName).Role = registered.Role
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Sales
+	report.UnverifiedTransactions = []string{}
+	err = scanPrefix(stub, "Transactions"+SEPARATOR, func(key string, value []byte) error {
+		var transaction Transaction
+		if err := json.Unmarshal(value, &transaction); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted transaction record %s: %s", key, err)
+		}
+		amount, err := strconv.ParseFloat(transaction.Amount, 64)
+		if err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted amount in transaction %s: %s", key, err)
+		}
+		report.ExpectedTotalBalance = report.ExpectedTotalBalance + amount
+		if len(transaction.Shares) == 0 {
+			report.UnverifiedTransactions = append(report.UnverifiedTransactions, transaction.TransactionId)
+			return nil
+		}
+		for _, share := range transaction.Shares {
+			company(share.CompanyName).ExpectedBalance += share.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Refunds
+	err = scanPrefix(stub, "Refunds"+SEPARATOR, func(key string, value []byte) error {
+		var refund Refund
+		if err := json.Unmarshal(value, &refund); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted refund %s: %s", key, err)
+		}
+		report.ExpectedTotalBalance = report.ExpectedTotalBalance - refund.Amount
+		for _, share := range refund.Shares {
+			company(share.CompanyName).ExpectedBalance -= share.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Adjustments, including the opening balances of the companies
+	err = scanPrefix(stub, "Adjustments"+SEPARATOR, func(key string, value []byte) error {
+		var adjustment BalanceAdjustment
+		if err := json.Unmarshal(value, &adjustment); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted adjustment %s: %s", key, err)
+		}
+		report.ExpectedTotalBalance = report.ExpectedTotalBalance + adjustment.Delta
+		company(adjustment.CompanyName).ExpectedBalance += adjustment.Delta
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Usage charges move amounts from the VMCs to the CSPs
+	err = scanPrefix(stub, "ESIMUsage"+SEPARATOR, func(key string, value []byte) error {
+		var usage ESIMUsage
+		if err := json.Unmarshal(value, &usage); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted usage record %s: %s", key, err)
+		}
+		if usage.Charge == 0 {
+			return nil
+		}
+		for _, share := range usage.Shares {
+			company(share.CompanyName).ExpectedBalance += share.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Settlements move amounts from the balance to the settled balance
+	err = scanPrefix(stub, "Settlements"+SEPARATOR, func(key string, value []byte) error {
+		var statement SettlementStatement
+		if err := json.Unmarshal(value, &statement); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted settlement statement %s: %s", key, err)
+		}
+		reconciliation := company(statement.CompanyName)
+		reconciliation.ExpectedBalance -= statement.Amount
+		reconciliation.ExpectedSettledBalance += statement.Amount
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The opening balance is the net credit of the equity account
+	equity, err := readAccount(stub, EQUITY_ACCOUNT)
+	if err != nil {
+		return nil, err
+	}
+	report.OpeningBalance = equity.Credit - equity.Debit
+	report.ExpectedTotalBalance = report.ExpectedTotalBalance + report.OpeningBalance
+
+	report.TotalBalance, err = readBalance(stub, "Total_Balance")
+	if err != nil {
+		return nil, err
+	}
+	report.TotalDiscrepancy = report.TotalBalance - report.ExpectedTotalBalance
+	report.Reconciled = math.Abs(report.TotalDiscrepancy) <= ACCOUNTING_EPSILON
+
+	companyNames := make([]string, 0, len(expected))
+	for companyName := range expected {
+		companyNames = append(companyNames, companyName)
+	}
+	sort.Strings(companyNames)
+
+	report.Companies = []CompanyReconciliation{}
+	for _, companyName := range companyNames {
+		reconciliation := expected[companyName]
+
+		reconciliation.Balance, err = readBalance(stub, companyKey(companyName, "Balance"))
+		if err != nil {
+			return nil, err
+		}
+		reconciliation.SettledBalance, err = readBalance(stub, companyKey(companyName, "Settled"))
+		if err != nil {
+			return nil, err
+		}
+		reconciliation.BalanceDiscrepancy = reconciliation.Balance - reconciliation.ExpectedBalance
+		reconciliation.SettledDiscrepancy = reconciliation.SettledBalance - reconciliation.ExpectedSettledBalance
+		reconciliation.Reconciled = math.Abs(reconciliation.BalanceDiscrepancy) <= ACCOUNTING_EPSILON &&
+			math.Abs(reconciliation.SettledDiscrepancy) <= ACCOUNTING_EPSILON
+		if !reconciliation.Reconciled {
+			report.Reconciled = false
+		}
+
+		report.CompanyBalancesSum = report.CompanyBalancesSum + reconciliation.Balance + reconciliation.SettledBalance
+		report.Companies = append(report.Companies, *reconciliation)
+	}
+	if math.Abs(report.TotalBalance-report.OpeningBalance-report.CompanyBalancesSum) > ACCOUNTING_EPSILON {
+		report.Reconciled = false
+	}
+
+	return json.Marshal(report)
+}
+
+// BalanceChange is the record stored under
+// BalanceHistory##<company>##<time>##<ledgerTxId>##<kind>##<reference>
+type BalanceChange struct {
+	CompanyName string  `json:"companyName"`
+	Time        string  `json:"time"`
+	TxId        string  `json:"txId"`
+	Kind        string  `json:"kind"`
+	Reference   string  `json:"reference"`
+	Change      float64 `json:"change"`
+	Balance     float64 `json:"balance"`
+}
+
+// +-----------------------------------------------------------------------------+
+// | changeBalance - add a signed amount to a company balance and log the change |
+// +-----------------------------------------------------------------------------+
+// Returns the new balance
+func changeBalance(stub shim.ChaincodeStubInterface, companyName string, delta float64, kind string, reference string) (float64, error) {
+	balance, err := addToBalance(stub, companyKey(companyName, "Balance"), delta)
+	if err != nil {
+		return 0, err
+	}
+
+	err = recordBalanceChange(stub, companyName, delta, balance, kind, reference)
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// +-------------------------------------------------------------------------+
+// | recordBalanceChange - store a change of a company balance in its history |
+// +-------------------------------------------------------------------------+
+// kind is the operation that changed the balance (Sale, Refund, Adjustment,
+// Settlement...) and reference the record of that operation.
+func recordBalanceChange(stub shim.ChaincodeStubInterface, companyName string, change float64, balance float64, kind string, reference string) error {
+	var balanceChange BalanceChange
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return err
+	}
+
+	balanceChange.CompanyName = companyName
+	balanceChange.Time = formatTime(now)
+	balanceChange.TxId = stub.GetTxID()
+	balanceChange.Kind = kind
+	balanceChange.Reference = reference
+	balanceChange.Change = change
+	balanceChange.Balance = balance
+
+	balanceChangeBytes, err := json.Marshal(balanceChange)
+	if err != nil {
+		return err
+	}
+	key := "BalanceHistory" + SEPARATOR + companyName + SEPARATOR + balanceChange.Time + SEPARATOR + balanceChange.TxId + SEPARATOR + kind + SEPARATOR + reference
+	return putState(stub, key, balanceChangeBytes)
+}
+
+// +-------------------------------------------------------------------------------+
+// | getBalanceHistory - query function to list the balance changes of a company   |
+// | Params - companyName, from, to, optional pageSize=, bookmark=                 |
+// +-------------------------------------------------------------------------------+
+// from and to are inclusive and can be left empty for an open range.
+func (t *SimpleChaincode) getBalanceHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyName, prefix, startKey, endKey string
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	if len(args) < 3 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3. Company name, from and to, followed by optional pageSize= and bookmark=")
+	}
+
+	companyName = args[0]
+	filters, err = parseFilters(args[3:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = "BalanceHistory" + SEPARATOR + companyName + SEPARATOR
+	startKey = prefix
+	endKey = prefix + "}"
+	if args[1] != "" {
+		from, _, err := parseDate(args[1])
+		if err != nil {
+			return nil, err
+		}
+		startKey = prefix + formatTime(from)
+	}
+	if args[2] != "" {
+		to, dateOnly, err := parseDate(args[2])
+		if err != nil {
+			return nil, err
+		}
+		// A date without time includes the whole day
+		if dateOnly {
+			to = to.Add(24*time.Hour - time.Second)
+		}
+		endKey = prefix + formatTime(to) + SEPARATOR + "}"
+	}
+
+	page, err = queryRangePage(stub, prefix, startKey, endKey, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getBalanceHistory failed", err)
+	}
+
+	return json.Marshal(page)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Manufacturer batches
+// A batch provisions many eSIMs in one transaction, the ICCID is the eSIM id.
+// The batch record and its report are stored under ESIMBatches##<batchId>.
+const MAX_BATCH_SIZE int = 5000
+
+// Results of the items of a batch
+const BATCH_ITEM_OK string = "OK"
+const BATCH_ITEM_REJECTED string = "REJECTED"
+
+// BatchItem is an eSIM profile of a manufacturer batch
+type BatchItem struct {
+	ICCID string `json:"iccid"`
+	EID   string `json:"eid,omitempty"`
+}
+
+// BatchItemResult is the outcome of an item of a batch, Item is its 1-based position
+type BatchItemResult struct {
+	Item   int    `json:"item"`
+	ICCID  string `json:"iccid"`
+	EID    string `json:"eid,omitempty"`
+	Result string `json:"result"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ESIMBatch is the record and report of a batch
+type ESIMBatch struct {
+	BatchId      string            `json:"batchId"`
+	Manufacturer string            `json:"manufacturer"`
+	Status       string            `json:"status"`
+	Actor        string            `json:"actor"`
+	Time         string            `json:"time"`
+	TxId         string            `json:"txId"`
+	Provisioned  int               `json:"provisioned"`
+	Rejected     int               `json:"rejected"`
+	Results      []BatchItemResult `json:"results"`
+}
+
+// +----------------------------------------------------------------------------+
+// | parseBatchItems - read the items of a batch payload                        |
+// +----------------------------------------------------------------------------+
+// The payload is either a JSON array of {"iccid":..., "eid":...} objects or
+// a compact CSV with one iccid[,eid] line per eSIM and an optional header line.
+func parseBatchItems(payload string) ([]BatchItem, error) {
+	var items []BatchItem
+
+	payload = strings.TrimSpace(payload)
+	if strings.HasPrefix(payload, "[") {
+		if err := json.Unmarshal([]byte(payload), &items); err != nil {
+			return nil, newError(ERR_INVALID_ARGS, "Invalid JSON batch payload: "+err.Error())
+		}
+		return items, nil
+	}
+
+	for i, line := range strings.Split(payload, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (i == 0 && strings.HasPrefix(strings.ToLower(line), "iccid")) {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) > 2 {
+			return nil, newError(ERR_INVALID_ARGS, "Invalid CSV batch payload at line "+strconv.Itoa(i+1)+". Expecting iccid[,eid]")
+		}
+		item := BatchItem{ICCID: strings.TrimSpace(fields[0])}
+		if len(fields) == 2 {
+			item.EID = strings.TrimSpace(fields[1])
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// +----------------------------------------------------------------------------+
+// | provisionESIMBatch - invoke function to add a manufacturer batch of eSIMs  |
+// | Params - batchId, manufacturer, status, payload                            |
+// +----------------------------------------------------------------------------+
+// Every item is checked first: ICCID and EID formats, duplicates within the
+// batch and eSIMs or EIDs already on the ledger. The batch is all or nothing,
+// when an item is rejected no eSIM is written and the error details hold the report.
+// Otherwise the report is returned and stored with the batch, see getESIMBatch.
+func (t *SimpleChaincode) provisionESIMBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var batch ESIMBatch
+
+	fmt.Println("running provisionESIMBatch()")
+
+	if len(args) != 4 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 4. Batch id, manufacturer, status and payload")
+	}
+
+	batch.BatchId = args[0]
+	batch.Manufacturer = args[1]
+	batch.Status = args[2]
+
+	err := validateId("batch id", batch.BatchId)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNewESIM(batch.Manufacturer, batch.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := stub.GetState("ESIMBatches" + SEPARATOR + batch.BatchId)
+	if err != nil {
+		return nil, errorf(ERR_LEDGER, "Failed to get state for batch %s: %s", batch.BatchId, err)
+	}
+	if len(existing) > 0 {
+		return nil, newError(ERR_CONFLICT, "Batch "+batch.BatchId+" already provisioned")
+	}
+
+	items, err := parseBatchItems(args[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Empty batch "+batch.BatchId)
+	}
+	if len(items) > MAX_BATCH_SIZE {
+		return nil, newError(ERR_INVALID_ARGS, "Batch "+batch.BatchId+" has "+strconv.Itoa(len(items))+" items. Expecting at most "+strconv.Itoa(MAX_BATCH_SIZE))
+	}
+
+	// Check every item before writing anything
+	seen := make(map[string]int)
+	for i, item := range items {
+		result := BatchItemResult{Item: i + 1, ICCID: item.ICCID, EID: item.EID, Result: BATCH_ITEM_OK}
+		itemErr := checkESIMIdentifiers(stub, item, seen)
+		if itemErr != nil {
+			chaincodeError := toChaincodeError(itemErr)
+			result.Result = BATCH_ITEM_REJECTED
+			result.Code = chaincodeError.Code
+			result.Error = chaincodeError.Message
+			batch.Rejected++
+		}
+		seen["ICCID"+SEPARATOR+item.ICCID] = i + 1
+		if item.EID != "" {
+			seen["EID"+SEPARATOR+item.EID] = i + 1
+		}
+		batch.Results = append(batch.Results, result)
+	}
+
+	if batch.Rejected > 0 {
+		reportBytes, err := json.Marshal(batch.Results)
+		if err != nil {
+			return nil, err
+		}
+		return nil, newError(ERR_INVALID_ARGS, "Batch "+batch.BatchId+" rejected, "+strconv.Itoa(batch.Rejected)+" invalid items",
+			"batchId", batch.BatchId, "report", string(reportBytes))
+	}
+
+	for _, item := range items {
+		err = createESIM(stub, item.ICCID, batch.Status, batch.Manufacturer, item.EID, batch.BatchId)
+		if err != nil {
+			return nil, err
+		}
+		batch.Provisioned++
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	batch.Actor = callerName(stub, "unknown")
+	batch.Time = formatTime(now)
+	batch.TxId = stub.GetTxID()
+
+	batchBytes, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, "ESIMBatches"+SEPARATOR+batch.BatchId, batchBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// The batch event replaces the events of the eSIMs of the batch
+	batchEvent := batch
+	batchEvent.Results = nil
+	err = emitEvent(stub, EVENT_ESIM_BATCH_PROVISIONED, batchEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("provisionESIMBatch provisioned " + strconv.Itoa(batch.Provisioned) + " eSIMs in batch " + batch.BatchId)
+	return batchBytes, nil
+}
+
+// +----------------------------------------------------------------------------+
+// | checkESIMIdentifiers - validate the ICCID and EID of a new eSIM            |
+// +----------------------------------------------------------------------------+
+// seen holds the ICCIDs and EIDs of the previous items of a batch with their position
+func checkESIMIdentifiers(stub shim.ChaincodeStubInterface, item BatchItem, seen map[string]int) error {
+	if err := validateICCID(item.ICCID); err != nil {
+		return err
+	}
+	if item.EID != "" {
+		if err := validateEID(item.EID); err != nil {
+			return err
+		}
+	}
+
+	if position, ok := seen["ICCID"+SEPARATOR+item.ICCID]; ok {
+		return newError(ERR_CONFLICT, "Duplicate ICCID "+item.ICCID+" of item "+strconv.Itoa(position))
+	}
+	if position, ok := seen["EID"+SEPARATOR+item.EID]; ok && item.EID != "" {
+		return newError(ERR_CONFLICT, "Duplicate EID "+item.EID+" of item "+strconv.Itoa(position))
+	}
+
+	status, err := getESIMStatus(stub, item.ICCID)
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		return newError(ERR_CONFLICT, "eSIM "+item.ICCID+" already exists, with status "+status)
+	}
+	if item.EID != "" {
+		eSIMIdBytes, err := stub.GetState("ESIMByEID" + SEPARATOR + item.EID)
+		if err != nil {
+			return errorf(ERR_LEDGER, "Failed to get state for EID %s: %s", item.EID, err)
+		}
+		if len(eSIMIdBytes) > 0 {
+			return newError(ERR_CONFLICT, "EID "+item.EID+" already paired with eSIM "+string(eSIMIdBytes))
+		}
+	}
+	return nil
+}
+
+// +----------------------------------------------------------------------------+
+// | getESIMBatch - query function to read a batch and its report              |
+// | Params - batchId                                                           |
+// +----------------------------------------------------------------------------+
+// Fails with NOT_FOUND for unknown batches
+func (t *SimpleChaincode) getESIMBatch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	batchBytes, err := stub.GetState("ESIMBatches" + SEPARATOR + args[0])
+	if err != nil {
+		return nil, ledgerError("get", "ESIMBatches"+SEPARATOR+args[0], err)
+	}
+	if len(batchBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown batch "+args[0], "batchId", args[0])
+	}
+
+	return batchBytes, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Company is the registry record stored under Companies##<companyName>
+// Deactivated companies are kept for the historical queries but cannot be part of new sales.
+type Company struct {
+	CompanyName   string `json:"companyName"`
+	Role          string `json:"role"`
+	Status        string `json:"status"`
+	DeactivatedAt string `json:"deactivatedAt,omitempty"`
+}
+
+// Company statuses
+const COMPANY_ACTIVE string = "Active"
+const COMPANY_DEACTIVATED string = "Deactivated"
+
+// +-------------------------------------------------------------------+
+// | registerCompany - add a company to the registry of companies      |
+// +-------------------------------------------------------------------+
+func registerCompany(stub shim.ChaincodeStubInterface, companyName string, role string) error {
+	companyBytes, err := json.Marshal(Company{CompanyName: companyName, Role: role, Status: COMPANY_ACTIVE})
+	if err != nil {
+		return err
+	}
+
+	return putState(stub, "Companies"+SEPARATOR+companyName, companyBytes)
+}
+
+// +-------------------------------------------------------------------+
+// | getCompany - read a company from the registry                     |
+// +-------------------------------------------------------------------+
+// found is false for companies that are not registered
+func getCompany(stub shim.ChaincodeStubInterface, companyName string) (company Company, found bool, err error) {
+	companyBytes, err := stub.GetState("Companies" + SEPARATOR + companyName)
+	if err != nil {
+		return company, false, errorf(ERR_LEDGER, "Failed to get state for company %s: %s", companyName, err)
+	}
+	if len(companyBytes) == 0 {
+		return company, false, nil
+	}
+	if err = json.Unmarshal(companyBytes, &company); err != nil {
+		return company, false, errorf(ERR_CORRUPTED_STATE, "Corrupted company %s: %s", companyName, err)
+	}
+	return company, true, nil
+}
+
+// +-----------------------------------------------------------------------+
+// | putCompany - write a company back to the registry                     |
+// +-----------------------------------------------------------------------+
+func putCompany(stub shim.ChaincodeStubInterface, company Company) error {
+	companyBytes, err := json.Marshal(company)
+	if err != nil {
+		return err
+	}
+
+	return putState(stub, "Companies"+SEPARATOR+company.CompanyName, companyBytes)
+}
+
+// +-----------------------------------------------------------------------+
+// | readPercentage - read the share of the sales earned by a company      |
+// +-----------------------------------------------------------------------+
+// VMCs have no percentage, they earn what is left: a missing key is zero
+func readPercentage(stub shim.ChaincodeStubInterface, companyName string) (float64, error) {
+	key := companyKey(companyName, "Percentage")
+	percentageBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, ledgerError("get", key, err)
+	}
+	if len(percentageBytes) == 0 {
+		return 0, nil
+	}
+
+	percentage, err := strconv.ParseFloat(string(percentageBytes), 64)
+	if err != nil {
+		return 0, errorf(ERR_CORRUPTED_STATE, "Corrupted percentage %s: %s", key, err)
+	}
+	return percentage, nil
+}
+
+// +-----------------------------------------------------------------------+
+// | checkPercentage - validate the percentage of a CSP or a supplier      |
+// +-----------------------------------------------------------------------+
+// A sale pays the CSP and the supplier their percentage and the VMC the rest,
+// so a percentage is between 0 and 1, and at most 1 with the percentage of
+// any registered company of the other role.
+func checkPercentage(stub shim.ChaincodeStubInterface, companyName string, role string, percentage float64) error {
+	if percentage < 0 || percentage > 1 {
+		return newError(ERR_INVALID_ARGS, "Invalid percentage "+strconv.FormatFloat(percentage, 'f', -1, 64)+". Expecting a number between 0 and 1")
+	}
+
+	otherRole := "CSP"
+	if role == "CSP" {
+		otherRole = "Supplier"
+	}
+	return scanPrefix(stub, "Companies"+SEPARATOR, func(key string, value []byte) error {
+		var company Company
+		if err := json.Unmarshal(value, &company); err != nil {
+			return errorf(ERR_CORRUPTED_STATE, "Corrupted company %s: %s", key, err)
+		}
+		if company.Role != otherRole {
+			return nil
+		}
+		otherPercentage, err := readPercentage(stub, company.CompanyName)
+		if err != nil {
+			return err
+		}
+		return checkPercentageSum(companyName, percentage, company.CompanyName, otherPercentage)
+	})
+}
+
+// checkPercentageSum fails when the percentages of a CSP and a supplier leave a negative share to the VMC
+func checkPercentageSum(companyName string, percentage float64, otherName string, otherPercentage float64) error {
+	if percentage+otherPercentage > 1+ACCOUNTING_EPSILON {
+		return newError(ERR_INVALID_ARGS, "Percentages of "+companyName+" ("+strconv.FormatFloat(percentage, 'f', -1, 64)+") and "+
+			otherName+" ("+strconv.FormatFloat(otherPercentage, 'f', -1, 64)+") are above 1, the VMC share would be negative")
+	}
+	return nil
+}
+
+// +-----------------------------------------------------------------------+
+// | checkCompanyActive - require an active company with the given role    |
+// +-----------------------------------------------------------------------+
+// Unregistered and removed companies are unknown, deactivated ones are rejected
+func checkCompanyActive(stub shim.ChaincodeStubInterface, companyName string, role string) error {
+	company, found, err := getCompany(stub, companyName)
+	if err != nil {
+		return err
+	}
+	if !found || company.Role != role {
+		return newError(ERR_NOT_FOUND, "Unknown "+role+" "+companyName, "companyName", companyName)
+	}
+	if company.Status == COMPANY_DEACTIVATED {
+		return newError(ERR_INVALID_STATE, "Company "+companyName+" is deactivated")
+	}
+	return nil
+}
+
+// +-----------------------------------------------------------------------------+
+// | checkCompanyRemovable - check that nothing depends on a company any more    |
+// +-----------------------------------------------------------------------------+
+// A company cannot be removed while it has an unsettled balance, a CSP while
+// it has active eSIMs, a VMC while eSIMs are bound to its machines or its
+// machines hold products, and a supplier while its products are in a machine.
+// Such companies can be deactivated instead.
+func checkCompanyRemovable(stub shim.ChaincodeStubInterface, companyName string, role string) error {
+	company, found, err := getCompany(stub, companyName)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return newError(ERR_NOT_FOUND, "Unknown "+role+" "+companyName, "companyName", companyName)
+	}
+	if company.Role != role {
+		return newError(ERR_INVALID_STATE, "Company "+companyName+" is a "+company.Role+", not a "+role)
+	}
+
+	balance, err := readBalance(stub, companyKey(companyName, "Balance"))
+	if err != nil {
+		return err
+	}
+	if balance != 0 {
+		return newError(ERR_INVALID_STATE, "Company "+companyName+" has an unsettled balance of "+strconv.FormatFloat(balance, 'f', -1, 64)+". Settle it or use deactivateCompany")
+	}
+
+	if role == "CSP" {
+		activeESIMs := 0
+		err = scanPrefix(stub, "ESIMByCSP"+SEPARATOR+companyName+SEPARATOR, func(key string, value []byte) error {
+			activeESIMs++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if activeESIMs > 0 {
+			return newError(ERR_INVALID_STATE, "CSP "+companyName+" has "+strconv.Itoa(activeESIMs)+" active eSIMs. Deactivate them or use deactivateCompany")
+		}
+	}
+
+	if role == "VMC" {
+		boundESIMs := 0
+		err = scanPrefix(stub, "ESIMByVMC"+SEPARATOR+companyName+SEPARATOR, func(key string, value []byte) error {
+			boundESIMs++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if boundESIMs > 0 {
+			return newError(ERR_INVALID_STATE, "VMC "+companyName+" has "+strconv.Itoa(boundESIMs)+" eSIMs bound to its machines. Unbind them or use deactivateCompany")
+		}
+	}
+
+	if role == "VMC" || role == "Supplier" {
+		// Format InventoryByProduct##EntityId##ProductId
+		prefix := "InventoryByProduct" + SEPARATOR
+		if role == "VMC" {
+			prefix = prefix + companyName + SEPARATOR
+		}
+		stocked := ""
+		err = scanPrefix(stub, prefix, func(key string, value []byte) error {
+			if stocked != "" {
+				return nil
+			}
+			quantity, err := strconv.Atoi(string(value))
+			if err != nil {
+				return errorf(ERR_CORRUPTED_STATE, "Corrupted quantity %s: %s", key, err)
+			}
+			if quantity <= 0 {
+				return nil
+			}
+			productId := key[strings.LastIndex(key, SEPARATOR)+len(SEPARATOR):]
+			if role == "VMC" {
+				stocked = productId
+				return nil
+			}
+			entityBytes, err := stub.GetState(productKey(productId, "Entity"))
+			if err != nil {
+				return ledgerError("get", productKey(productId, "Entity"), err)
+			}
+			if string(entityBytes) == companyName {
+				stocked = productId
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if stocked != "" {
+			return newError(ERR_INVALID_STATE, "Company "+companyName+" still has product "+stocked+" in a machine. Empty the machines or use deactivateCompany")
+		}
+	}
+
+	return nil
+}
+
+// +--------------------------------------------------------------------------+
+// | deactivateCompany - invoke function to deactivate a company              |
+// | Params - companyName                                                     |
+// +--------------------------------------------------------------------------+
+// The balances and records of the company are kept, but it cannot take part
+// in new sales until it is reactivated. Restricted to the admin role.
+func (t *SimpleChaincode) deactivateCompany(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return setCompanyStatus(stub, args, COMPANY_DEACTIVATED)
+}
+
+// +--------------------------------------------------------------------------+
+// | reactivateCompany - invoke function to reactivate a deactivated company  |
+// | Params - companyName                                                     |
+// +--------------------------------------------------------------------------+
+// Restricted to the admin role
+func (t *SimpleChaincode) reactivateCompany(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return setCompanyStatus(stub, args, COMPANY_ACTIVE)
+}
+
+// setCompanyStatus implements deactivateCompany and reactivateCompany
+func setCompanyStatus(stub shim.ChaincodeStubInterface, args []string, status string) ([]byte, error) {
+	function := "deactivateCompany"
+	if status == COMPANY_ACTIVE {
+		function = "reactivateCompany"
+	}
+	if _, err := checkAdmin(stub, function); err != nil {
+		return nil, err
+	}
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	company, found, err := getCompany(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown company "+args[0], "companyName", args[0])
+	}
+	if company.Status == status {
+		return nil, newError(ERR_CONFLICT, "Company "+args[0]+" is already "+status)
+	}
+
+	company.Status = status
+	company.DeactivatedAt = ""
+	if status == COMPANY_DEACTIVATED {
+		now, err := transactionTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		company.DeactivatedAt = formatTime(now)
+	}
+
+	err = putCompany(stub, company)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_COMPANY_STATUS_CHANGED, CompanyEvent{CompanyName: company.CompanyName, Role: company.Role, Status: company.Status})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("running setCompanyStatus() " + args[0] + " " + status)
+	return nil, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Error codes
+// Every invoke and query fails with a ChaincodeError, serialized as JSON:
+// {"code":"NOT_FOUND","message":"Unknown eSIM 89...","details":{"eSIMId":"89..."}}
+// Clients switch on the code, the message is meant for humans.
+const ERR_INVALID_ARGS string = "INVALID_ARGS"
+const ERR_NOT_FOUND string = "NOT_FOUND"
+const ERR_INSUFFICIENT_STOCK string = "INSUFFICIENT_STOCK"
+const ERR_UNAUTHORIZED string = "UNAUTHORIZED"
+const ERR_CONFLICT string = "CONFLICT"
+const ERR_INVALID_STATE string = "INVALID_STATE"
+const ERR_LEDGER string = "LEDGER_ERROR"
+const ERR_CORRUPTED_STATE string = "CORRUPTED_STATE"
+const ERR_INTERNAL string = "INTERNAL"
+
+// ChaincodeError is the error returned by every invoke and query
+type ChaincodeError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Error serializes the error, the shim hands this string to the client
+func (e *ChaincodeError) Error() string {
+	errorBytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(errorBytes)
+}
+
+// +-------------------------------------------------------------------+
+// | newError - create an error with a code, a message and details     |
+// +-------------------------------------------------------------------+
+// details are name and value pairs
+func newError(code string, message string, details ...string) *ChaincodeError {
+	chaincodeError := &ChaincodeError{Code: code, Message: message}
+	for i := 0; i+1 < len(details); i += 2 {
+		if chaincodeError.Details == nil {
+			chaincodeError.Details = make(map[string]string)
+		}
+		chaincodeError.Details[details[i]] = details[i+1]
+	}
+	return chaincodeError
+}
+
+// errorf creates an error with a code and a formatted message
+func errorf(code string, format string, args ...interface{}) *ChaincodeError {
+	return newError(code, fmt.Sprintf(format, args...))
+}
+
+// +-------------------------------------------------------------------+
+// | ledgerError - create the error of a failed GetState, PutState...  |
+// +-------------------------------------------------------------------+
+// operation is get, put or delete
+func ledgerError(operation string, key string, err error) *ChaincodeError {
+	return newError(ERR_LEDGER, "Failed to "+operation+" state for "+key, "key", key, "cause", err.Error())
+}
+
+// +-------------------------------------------------------------------+
+// | wrapError - prefix the message of an error, keeping its code      |
+// +-------------------------------------------------------------------+
+func wrapError(prefix string, err error) *ChaincodeError {
+	chaincodeError := toChaincodeError(err)
+	wrapped := *chaincodeError
+	wrapped.Message = prefix + ": " + chaincodeError.Message
+	return &wrapped
+}
+
+// +-------------------------------------------------------------------+
+// | toChaincodeError - give a code to any error                       |
+// +-------------------------------------------------------------------+
+// Errors without a code, from the shim or the JSON encoder, are INTERNAL
+func toChaincodeError(err error) *ChaincodeError {
+	if chaincodeError, ok := err.(*ChaincodeError); ok {
+		return chaincodeError
+	}
+	return newError(ERR_INTERNAL, err.Error())
+}
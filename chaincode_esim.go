@@ -0,0 +1,837 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// IoT secrets
+// The secret of an activated eSIM is never stored, only a salted SHA-256 hash:
+// - ESIM##<eSIMId>##IoTSecretSalt is the salt, derived from the activation transaction
+// - ESIM##<eSIMId>##IoTSecretHash is hex(sha256(salt + secret))
+// This shim has no transient data, the secret is an argument of activateESIM
+// and must be sent in a confidential transaction to stay off the chain.
+
+// +----------------------------------------------------------------+
+// | hashIoTSecret - hash an IoT secret with its salt               |
+// +----------------------------------------------------------------+
+func hashIoTSecret(salt string, secret string) string {
+	hash := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// +----------------------------------------------------------------------+
+// | storeIoTSecret - store the salted hash of the IoT secret of an eSIM  |
+// +----------------------------------------------------------------------+
+// The salt must be the same on every peer, it is derived from the transaction id.
+func storeIoTSecret(stub shim.ChaincodeStubInterface, eSIMId string, secret string) error {
+	if secret == "" {
+		return newError(ERR_INVALID_ARGS, "Missing IoT secret of eSIM "+eSIMId)
+	}
+
+	saltHash := sha256.Sum256([]byte(stub.GetTxID() + SEPARATOR + eSIMId))
+	salt := hex.EncodeToString(saltHash[:16])
+
+	err := putState(stub, eSIMKey(eSIMId, "IoTSecretSalt"), []byte(salt))
+	if err != nil {
+		return err
+	}
+	return putState(stub, eSIMKey(eSIMId, "IoTSecretHash"), []byte(hashIoTSecret(salt, secret)))
+}
+
+// +------------------------------------------------------------------------+
+// | verifyIoTSecret - query function to check the IoT secret of an eSIM    |
+// | Params - eSIMId, secret                                                |
+// +------------------------------------------------------------------------+
+// Returns {"eSIMId":..., "valid":true|false}, the stored hash is never returned.
+// A suspended eSIM does not verify until it is resumed or its suspension expires.
+func (t *SimpleChaincode) verifyIoTSecret(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var verification struct {
+		ESIMId string `json:"eSIMId"`
+		Valid  bool   `json:"valid"`
+	}
+
+	if len(args) != 2 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2. eSIM id and IoT secret")
+	}
+
+	verification.ESIMId = args[0]
+
+	saltBytes, err := stub.GetState(eSIMKey(args[0], "IoTSecretSalt"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(args[0], "IoTSecretSalt"), err)
+	}
+	hashBytes, err := stub.GetState(eSIMKey(args[0], "IoTSecretHash"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(args[0], "IoTSecretHash"), err)
+	}
+
+	usable, err := isESIMUsable(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// An eSIM without secret, not active or unknown, never verifies
+	if usable && len(hashBytes) > 0 {
+		hash := hashIoTSecret(string(saltBytes), args[1])
+		verification.Valid = subtle.ConstantTimeCompare([]byte(hash), hashBytes) == 1
+	}
+
+	return json.Marshal(verification)
+}
+
+// eSIM lifecycle
+// Provisioned -> Available -> Active <-> Suspended -> Deactivated -> Available
+// and Provisioned, Available or Deactivated -> Retired, the final state.
+// Every transition is stored under ESIMHistory##<eSIMId>##<time>##<txId>##<state>.
+//
+// eSIM indexes, the value is the eSIM id
+// - ESIMByStatus##<status>##<eSIMId> for every eSIM
+// - ESIMByManufacturer##<manufacturer>##<eSIMId> for every eSIM
+// - ESIMByEID##<EID> for the eSIMs paired with an EID, it keeps EIDs unique
+// - ESIMByCSP##<CSP>##<eSIMId> and ESIMByEndUser##<endUser>##<eSIMId> while activated
+// - ESIMByVMC##<VMC>##<eSIMId> while bound to a machine of the VMC
+const ESIM_PROVISIONED string = "Provisioned"
+const ESIM_AVAILABLE string = "Available"
+const ESIM_ACTIVE string = "Active"
+const ESIM_SUSPENDED string = "Suspended"
+const ESIM_DEACTIVATED string = "Deactivated"
+const ESIM_RETIRED string = "Retired"
+
+// Allowed transitions, by current state
+var ESIM_TRANSITIONS = map[string][]string{
+	ESIM_PROVISIONED: {ESIM_AVAILABLE, ESIM_RETIRED},
+	ESIM_AVAILABLE:   {ESIM_ACTIVE, ESIM_RETIRED},
+	ESIM_ACTIVE:      {ESIM_SUSPENDED, ESIM_DEACTIVATED},
+	ESIM_SUSPENDED:   {ESIM_ACTIVE, ESIM_DEACTIVATED},
+	ESIM_DEACTIVATED: {ESIM_AVAILABLE, ESIM_RETIRED},
+	ESIM_RETIRED:     {},
+}
+
+// ESIMTransition is a change of state of an eSIM, a suspension holds its
+// reason and expiry
+type ESIMTransition struct {
+	ESIMId     string          `json:"eSIMId"`
+	From       string          `json:"from"`
+	To         string          `json:"to"`
+	Actor      string          `json:"actor"`
+	Time       string          `json:"time"`
+	TxId       string          `json:"txId"`
+	Suspension *ESIMSuspension `json:"suspension,omitempty"`
+}
+
+// +----------------------------------------------------------------------+
+// | getESIMStatus - read the state of an eSIM, empty for unknown eSIMs   |
+// +----------------------------------------------------------------------+
+func getESIMStatus(stub shim.ChaincodeStubInterface, eSIMId string) (string, error) {
+	statusBytes, err := stub.GetState(eSIMKey(eSIMId, "Status"))
+	if err != nil {
+		return "", ledgerError("get", eSIMKey(eSIMId, "Status"), err)
+	}
+	return string(statusBytes), nil
+}
+
+// +----------------------------------------------------------------------+
+// | transitionESIM - move an eSIM to a new state and log the transition  |
+// +----------------------------------------------------------------------+
+// An empty from is the creation of the eSIM. Returns the previous state.
+func transitionESIM(stub shim.ChaincodeStubInterface, eSIMId string, to string) (string, error) {
+	return recordESIMTransition(stub, eSIMId, to, nil)
+}
+
+// recordESIMTransition implements transitionESIM, the suspension of a move
+// to Suspended is stored in the history and sent with the event
+func recordESIMTransition(stub shim.ChaincodeStubInterface, eSIMId string, to string, suspension *ESIMSuspension) (string, error) {
+	var transition ESIMTransition
+
+	from, err := getESIMStatus(stub, eSIMId)
+	if err != nil {
+		return "", err
+	}
+	if from == "" && to != ESIM_PROVISIONED && to != ESIM_AVAILABLE {
+		return "", newError(ERR_NOT_FOUND, "Unknown eSIM "+eSIMId, "eSIMId", eSIMId)
+	}
+	if from != "" {
+		allowed, ok := ESIM_TRANSITIONS[from]
+		if !ok {
+			return "", newError(ERR_CORRUPTED_STATE, "eSIM "+eSIMId+" has an unknown state "+from)
+		}
+		if !containsString(allowed, to) {
+			return "", newError(ERR_INVALID_STATE, "Illegal transition of eSIM "+eSIMId+" from "+from+" to "+to)
+		}
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return "", err
+	}
+	transition.ESIMId = eSIMId
+	transition.From = from
+	transition.To = to
+	transition.Actor = callerName(stub, "unknown")
+	transition.Time = formatTime(now)
+	transition.TxId = stub.GetTxID()
+	transition.Suspension = suspension
+
+	err = putState(stub, eSIMKey(eSIMId, "Status"), []byte(to))
+	if err != nil {
+		return "", err
+	}
+	if from != "" {
+		err = delState(stub, "ESIMByStatus"+SEPARATOR+from+SEPARATOR+eSIMId)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = putState(stub, "ESIMByStatus"+SEPARATOR+to+SEPARATOR+eSIMId, []byte(eSIMId))
+	if err != nil {
+		return "", err
+	}
+
+	transitionBytes, err := json.Marshal(transition)
+	if err != nil {
+		return "", err
+	}
+	key := "ESIMHistory" + SEPARATOR + eSIMId + SEPARATOR + transition.Time + SEPARATOR + transition.TxId + SEPARATOR + to
+	err = putState(stub, key, transitionBytes)
+	if err != nil {
+		return "", err
+	}
+	err = emitEvent(stub, EVENT_ESIM_STATE_CHANGED, transition)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("eSIM " + eSIMId + " moved from " + from + " to " + to)
+	return from, nil
+}
+
+// containsString reports whether list contains value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// +-----------------------------------------------------------------------+
+// | makeESIMAvailable - invoke function to make an eSIM available         |
+// | Params - eSIMId                                                       |
+// +-----------------------------------------------------------------------+
+// A provisioned eSIM becomes available for activation, a deactivated eSIM
+// can be activated again.
+func (t *SimpleChaincode) makeESIMAvailable(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("running makeESIMAvailable()")
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	_, err := transitionESIM(stub, args[0], ESIM_AVAILABLE)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// +-----------------------------------------------------------------------+
+// | getESIMHistory - query function to list the transitions of an eSIM    |
+// | Params - eSIMId, optional pageSize=, bookmark=                        |
+// +-----------------------------------------------------------------------+
+func (t *SimpleChaincode) getESIMHistory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting eSIM id, followed by optional pageSize= and bookmark=")
+	}
+
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err = queryPage(stub, "ESIMHistory"+SEPARATOR+args[0]+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getESIMHistory failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// ESIM is an eSIM as returned by the eSIM queries
+type ESIM struct {
+	ESIMId       string          `json:"eSIMId"`
+	Status       string          `json:"status"`
+	CSPName      string          `json:"CSP"`
+	Manufacturer string          `json:"manufacturer"`
+	EndUserId    string          `json:"EndUser"`
+	IoTId        string          `json:"IoTId"`
+	EID          string          `json:"EID,omitempty"`
+	BatchId      string          `json:"batchId,omitempty"`
+	MachineId    string          `json:"machineId,omitempty"`
+	VMCName      string          `json:"VMC,omitempty"`
+	Suspension   *ESIMSuspension `json:"suspension,omitempty"`
+}
+
+// ESIMSuspension is a temporary block of an eSIM, stored under ESIM##<eSIMId>##Suspension.
+// An empty ExpiresAt never expires.
+type ESIMSuspension struct {
+	Reason      string `json:"reason"`
+	Actor       string `json:"actor"`
+	SuspendedAt string `json:"suspendedAt"`
+	ExpiresAt   string `json:"expiresAt,omitempty"`
+	Expired     bool   `json:"expired"`
+}
+
+// +----------------------------------------------------------------------+
+// | getESIMRecord - read all the attributes of an eSIM                   |
+// +----------------------------------------------------------------------+
+// found is false for an unknown eSIM
+func getESIMRecord(stub shim.ChaincodeStubInterface, eSIMId string) (eSIM ESIM, found bool, err error) {
+	attributes := map[string]*string{
+		"Status":       &eSIM.Status,
+		"CSP":          &eSIM.CSPName,
+		"Manufacturer": &eSIM.Manufacturer,
+		"EndUser":      &eSIM.EndUserId,
+		"IoTId":        &eSIM.IoTId,
+		"EID":          &eSIM.EID,
+		"Batch":        &eSIM.BatchId,
+		"Machine":      &eSIM.MachineId,
+		"VMC":          &eSIM.VMCName,
+	}
+
+	eSIM.ESIMId = eSIMId
+	for attribute, value := range attributes {
+		valueBytes, err := stub.GetState(eSIMKey(eSIMId, attribute))
+		if err != nil {
+			return eSIM, false, ledgerError("get", eSIMKey(eSIMId, attribute), err)
+		}
+		*value = string(valueBytes)
+	}
+	if eSIM.Status == "" {
+		return eSIM, false, nil
+	}
+
+	if eSIM.Status == ESIM_SUSPENDED {
+		suspension, err := getESIMSuspension(stub, eSIMId)
+		if err != nil {
+			return eSIM, true, err
+		}
+		eSIM.Suspension = &suspension
+	}
+	return eSIM, true, nil
+}
+
+// +----------------------------------------------------------------------+
+// | getESIMSuspension - read the suspension of an eSIM                   |
+// +----------------------------------------------------------------------+
+// Expired is set against the time of the current transaction
+func getESIMSuspension(stub shim.ChaincodeStubInterface, eSIMId string) (ESIMSuspension, error) {
+	var suspension ESIMSuspension
+
+	suspensionBytes, err := stub.GetState(eSIMKey(eSIMId, "Suspension"))
+	if err != nil {
+		return suspension, ledgerError("get", eSIMKey(eSIMId, "Suspension"), err)
+	}
+	if len(suspensionBytes) == 0 {
+		return suspension, nil
+	}
+	if err = json.Unmarshal(suspensionBytes, &suspension); err != nil {
+		return suspension, errorf(ERR_CORRUPTED_STATE, "Corrupted suspension of eSIM %s: %s", eSIMId, err)
+	}
+
+	if suspension.ExpiresAt != "" {
+		expiresAt, _, err := parseDate(suspension.ExpiresAt)
+		if err != nil {
+			return suspension, errorf(ERR_CORRUPTED_STATE, "Corrupted suspension of eSIM %s: %s", eSIMId, toChaincodeError(err).Message)
+		}
+		now, err := transactionTime(stub)
+		if err != nil {
+			return suspension, err
+		}
+		suspension.Expired = !now.Before(expiresAt)
+	}
+	return suspension, nil
+}
+
+// +----------------------------------------------------------------------+
+// | isESIMUsable - check that an eSIM can be used by its device          |
+// +----------------------------------------------------------------------+
+// An Active eSIM is usable, and so is a Suspended eSIM whose suspension expired
+func isESIMUsable(stub shim.ChaincodeStubInterface, eSIMId string) (bool, error) {
+	status, err := getESIMStatus(stub, eSIMId)
+	if err != nil {
+		return false, err
+	}
+	if status == ESIM_ACTIVE {
+		return true, nil
+	}
+	if status != ESIM_SUSPENDED {
+		return false, nil
+	}
+	suspension, err := getESIMSuspension(stub, eSIMId)
+	if err != nil {
+		return false, err
+	}
+	return suspension.Expired, nil
+}
+
+// +------------------------------------------------------------------------+
+// | suspendESIM - invoke function to block an active eSIM temporarily     |
+// | Params - eSIMId, reason, optional expiresAt                           |
+// +------------------------------------------------------------------------+
+// The eSIM keeps its CSP, end user and IoT credentials. It is usable again
+// after resumeESIM, or once expiresAt is past.
+func (t *SimpleChaincode) suspendESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var suspension ESIMSuspension
+	var eSIMId string
+
+	fmt.Println("running suspendESIM()")
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2 or 3. eSIM id, reason and optional expiry date")
+	}
+
+	eSIMId = args[0]
+	suspension.Reason = strings.TrimSpace(args[1])
+	if suspension.Reason == "" {
+		return nil, newError(ERR_INVALID_ARGS, "Missing reason of the suspension of eSIM "+eSIMId)
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 3 && args[2] != "" {
+		expiresAt, _, err := parseDate(args[2])
+		if err != nil {
+			return nil, err
+		}
+		if !expiresAt.After(now) {
+			return nil, newError(ERR_INVALID_ARGS, "Suspension expiry "+args[2]+" is not in the future")
+		}
+		suspension.ExpiresAt = formatTime(expiresAt)
+	}
+	suspension.Actor = callerName(stub, "unknown")
+	suspension.SuspendedAt = formatTime(now)
+
+	_, err = recordESIMTransition(stub, eSIMId, ESIM_SUSPENDED, &suspension)
+	if err != nil {
+		return nil, err
+	}
+
+	suspensionBytes, err := json.Marshal(suspension)
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, eSIMKey(eSIMId, "Suspension"), suspensionBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// +------------------------------------------------------------------------+
+// | resumeESIM - invoke function to lift the suspension of an eSIM        |
+// | Params - eSIMId                                                       |
+// +------------------------------------------------------------------------+
+func (t *SimpleChaincode) resumeESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("running resumeESIM()")
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	from, err := getESIMStatus(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if from != ESIM_SUSPENDED {
+		return nil, newError(ERR_INVALID_STATE, "eSIM "+args[0]+" is not suspended")
+	}
+
+	_, err = transitionESIM(stub, args[0], ESIM_ACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	err = delState(stub, eSIMKey(args[0], "Suspension"))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// +-------------------------------------------------------------------------------+
+// | searchESIMs - query function to list the eSIMs with filters                   |
+// | Params - optional filters: status=, manufacturer=, csp=, endUser=,            |
+// |          pageSize=, bookmark=                                                 |
+// +-------------------------------------------------------------------------------+
+// The most selective filter picks the index that is ranged over, the other
+// filters are applied to the eSIM records. Without filters all the eSIMs are listed.
+// A bookmark is only valid with the same filters as the query that returned it.
+func (t *SimpleChaincode) searchESIMs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var prefix string
+	var err error
+
+	fmt.Println("running searchESIMs()")
+
+	filters, err = parseFilters(args, "status", "manufacturer", "csp", "endUser", "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick the index to range over
+	if endUser, ok := filters["endUser"]; ok {
+		prefix = "ESIMByEndUser" + SEPARATOR + endUser + SEPARATOR
+	} else if csp, ok := filters["csp"]; ok {
+		prefix = "ESIMByCSP" + SEPARATOR + csp + SEPARATOR
+	} else if manufacturer, ok := filters["manufacturer"]; ok {
+		prefix = "ESIMByManufacturer" + SEPARATOR + manufacturer + SEPARATOR
+	} else if status, ok := filters["status"]; ok {
+		prefix = "ESIMByStatus" + SEPARATOR + status + SEPARATOR
+	} else {
+		prefix = "ESIMByStatus" + SEPARATOR
+	}
+
+	page, err = queryPage(stub, prefix, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		eSIM, found, err := getESIMRecord(stub, string(value))
+		if err != nil {
+			return nil, err
+		}
+		if !found || !eSIM.matches(filters) {
+			return nil, nil
+		}
+		return json.Marshal(eSIM)
+	})
+	if err != nil {
+		return nil, wrapError("searchESIMs failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// matches checks the eSIM against the filters of searchESIMs
+func (e ESIM) matches(filters map[string]string) bool {
+	if status, ok := filters["status"]; ok && status != e.Status {
+		return false
+	}
+	if manufacturer, ok := filters["manufacturer"]; ok && manufacturer != e.Manufacturer {
+		return false
+	}
+	if csp, ok := filters["csp"]; ok && csp != e.CSPName {
+		return false
+	}
+	if endUser, ok := filters["endUser"]; ok && endUser != e.EndUserId {
+		return false
+	}
+	return true
+}
+
+// ESIMFleetSummary counts the eSIMs per status, overall and per CSP
+type ESIMFleetSummary struct {
+	Total      int                       `json:"total"`
+	ByStatus   map[string]int            `json:"byStatus"`
+	ByCSP      map[string]map[string]int `json:"byCSP"`
+	Unassigned map[string]int            `json:"unassigned"`
+}
+
+// +-------------------------------------------------------------------------------+
+// | getESIMFleetSummary - query function to count the eSIMs per status per CSP    |
+// +-------------------------------------------------------------------------------+
+// eSIMs that are not bound to a CSP are counted in unassigned
+func (t *SimpleChaincode) getESIMFleetSummary(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var summary ESIMFleetSummary
+
+	if len(args) != 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 0")
+	}
+
+	// Format ESIMByCSP##CSP##eSIMId
+	prefix := "ESIMByCSP" + SEPARATOR
+	CSPNames := make(map[string]string)
+	err := scanPrefix(stub, prefix, func(key string, value []byte) error {
+		parts := strings.Split(key[len(prefix):], SEPARATOR)
+		CSPNames[string(value)] = parts[0]
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("getESIMFleetSummary failed", err)
+	}
+
+	summary.ByStatus = make(map[string]int)
+	summary.ByCSP = make(map[string]map[string]int)
+	summary.Unassigned = make(map[string]int)
+
+	// Format ESIMByStatus##Status##eSIMId
+	prefix = "ESIMByStatus" + SEPARATOR
+	err = scanPrefix(stub, prefix, func(key string, value []byte) error {
+		status := strings.Split(key[len(prefix):], SEPARATOR)[0]
+		summary.Total++
+		summary.ByStatus[status]++
+
+		CSPName, ok := CSPNames[string(value)]
+		if !ok {
+			summary.Unassigned[status]++
+			return nil
+		}
+		if summary.ByCSP[CSPName] == nil {
+			summary.ByCSP[CSPName] = make(map[string]int)
+		}
+		summary.ByCSP[CSPName][status]++
+		return nil
+	})
+	if err != nil {
+		return nil, wrapError("getESIMFleetSummary failed", err)
+	}
+
+	return json.Marshal(summary)
+}
+
+// +--------------------------------------------------------------------------+
+// | bindESIM - invoke function to bind an eSIM to a vending machine          |
+// | Params - eSIMId, machineId, VMCName                                      |
+// +--------------------------------------------------------------------------+
+// The machine id is the entity id of the inventory. A machine has at most one
+// eSIM, stored under Machine##<machineId>##ESIM, and its sales are credited to
+// the CSP of that eSIM.
+func (t *SimpleChaincode) bindESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var eSIMId, machineId, VMCName string
+
+	fmt.Println("running bindESIM()")
+
+	if len(args) != 3 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3. eSIM id, machine id and VMC name")
+	}
+
+	eSIMId = args[0]
+	machineId = args[1]
+	VMCName = args[2]
+
+	err := validateIds("eSIM id", eSIMId, "machine id", machineId, "VMC name", VMCName)
+	if err != nil {
+		return nil, err
+	}
+
+	eSIM, found, err := getESIMRecord(stub, eSIMId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown eSIM "+eSIMId, "eSIMId", eSIMId)
+	}
+	if eSIM.Status != ESIM_ACTIVE && eSIM.Status != ESIM_SUSPENDED {
+		return nil, newError(ERR_INVALID_STATE, "Cannot bind eSIM "+eSIMId+" in state "+eSIM.Status+". Expecting "+ESIM_ACTIVE+" or "+ESIM_SUSPENDED)
+	}
+	if eSIM.MachineId != "" {
+		return nil, newError(ERR_CONFLICT, "eSIM "+eSIMId+" is already bound to machine "+eSIM.MachineId)
+	}
+
+	if err = checkCompanyActive(stub, VMCName, "VMC"); err != nil {
+		return nil, err
+	}
+
+	boundBytes, err := stub.GetState(machineKey(machineId, "ESIM"))
+	if err != nil {
+		return nil, ledgerError("get", machineKey(machineId, "ESIM"), err)
+	}
+	if len(boundBytes) > 0 {
+		return nil, newError(ERR_CONFLICT, "Machine "+machineId+" already has eSIM "+string(boundBytes))
+	}
+
+	bindings := [][2]string{
+		{eSIMKey(eSIMId, "Machine"), machineId},
+		{eSIMKey(eSIMId, "VMC"), VMCName},
+		{machineKey(machineId, "ESIM"), eSIMId},
+		{"ESIMByVMC" + SEPARATOR + VMCName + SEPARATOR + eSIMId, eSIMId},
+	}
+	for _, binding := range bindings {
+		if err = putState(stub, binding[0], []byte(binding[1])); err != nil {
+			return nil, err
+		}
+	}
+
+	err = emitEvent(stub, EVENT_ESIM_BOUND, ESIM{ESIMId: eSIMId, Status: eSIM.Status, CSPName: eSIM.CSPName, MachineId: machineId, VMCName: VMCName})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | unbindESIM - invoke function to detach an eSIM from its machine          |
+// | Params - eSIMId                                                          |
+// +--------------------------------------------------------------------------+
+func (t *SimpleChaincode) unbindESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	fmt.Println("running unbindESIM()")
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	machineBytes, err := stub.GetState(eSIMKey(args[0], "Machine"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(args[0], "Machine"), err)
+	}
+	if len(machineBytes) == 0 {
+		return nil, newError(ERR_INVALID_STATE, "eSIM "+args[0]+" is not bound to a machine")
+	}
+
+	err = unbindMachine(stub, args[0], string(machineBytes))
+	if err != nil {
+		return nil, err
+	}
+	err = emitEvent(stub, EVENT_ESIM_UNBOUND, ESIM{ESIMId: args[0], MachineId: string(machineBytes)})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | unbindMachine - delete the binding between an eSIM and a machine         |
+// +--------------------------------------------------------------------------+
+func unbindMachine(stub shim.ChaincodeStubInterface, eSIMId string, machineId string) error {
+	VMCNameBytes, err := stub.GetState(eSIMKey(eSIMId, "VMC"))
+	if err != nil {
+		return ledgerError("get", eSIMKey(eSIMId, "VMC"), err)
+	}
+
+	return delState(stub, eSIMKey(eSIMId, "Machine"), eSIMKey(eSIMId, "VMC"), machineKey(machineId, "ESIM"),
+		"ESIMByVMC"+SEPARATOR+string(VMCNameBytes)+SEPARATOR+eSIMId)
+}
+
+// +--------------------------------------------------------------------------+
+// | hasBoundMachines - whether eSIMs are bound to machines of a VMC          |
+// +--------------------------------------------------------------------------+
+// Reads at most one key of the ESIMByVMC index.
+func hasBoundMachines(stub shim.ChaincodeStubInterface, VMCName string) (bool, error) {
+	prefix := "ESIMByVMC" + SEPARATOR + VMCName + SEPARATOR
+	keys, _, err := readRange(stub, prefix, prefix, prefix+"}", 0, make(map[string][]byte))
+	if err != nil {
+		return false, err
+	}
+	return len(keys) > 0, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | machineCSP - CSP of the eSIM bound to a vending machine                  |
+// +--------------------------------------------------------------------------+
+// Fails when the machine has no eSIM, when the eSIM is not usable or when the
+// machine is not operated by VMCName. Returns the CSP and the eSIM id.
+func machineCSP(stub shim.ChaincodeStubInterface, machineId string, VMCName string) (string, string, error) {
+	eSIMIdBytes, err := stub.GetState(machineKey(machineId, "ESIM"))
+	if err != nil {
+		return "", "", ledgerError("get", machineKey(machineId, "ESIM"), err)
+	}
+	if len(eSIMIdBytes) == 0 {
+		return "", "", newError(ERR_NOT_FOUND, "Machine "+machineId+" has no eSIM")
+	}
+	eSIMId := string(eSIMIdBytes)
+
+	eSIM, found, err := getESIMRecord(stub, eSIMId)
+	if err != nil {
+		return "", "", err
+	}
+	if !found {
+		return "", "", newError(ERR_NOT_FOUND, "Unknown eSIM "+eSIMId+" of machine "+machineId)
+	}
+	if eSIM.VMCName != VMCName {
+		return "", "", newError(ERR_CONFLICT, "Machine "+machineId+" is operated by "+eSIM.VMCName+", not by "+VMCName)
+	}
+	usable, err := isESIMUsable(stub, eSIMId)
+	if err != nil {
+		return "", "", err
+	}
+	if !usable {
+		return "", "", newError(ERR_INVALID_STATE, "eSIM "+eSIMId+" of machine "+machineId+" is "+eSIM.Status)
+	}
+	return eSIM.CSPName, eSIMId, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | validateNewESIM - check the manufacturer and initial status of an eSIM   |
+// +--------------------------------------------------------------------------+
+// A new eSIM is either Provisioned or directly Available
+func validateNewESIM(manufacturer string, status string) error {
+	if manufacturer == "" || strings.Contains(manufacturer, SEPARATOR) {
+		return newError(ERR_INVALID_ARGS, "Invalid manufacturer \""+manufacturer+"\"")
+	}
+	if status != ESIM_PROVISIONED && status != ESIM_AVAILABLE {
+		return newError(ERR_INVALID_ARGS, "Invalid status "+status+" for a new eSIM. Expecting "+ESIM_PROVISIONED+" or "+ESIM_AVAILABLE)
+	}
+	return nil
+}
+
+// +--------------------------------------------------------------------------+
+// | createESIM - write a new eSIM and its indexes                            |
+// +--------------------------------------------------------------------------+
+// eid and batchId are optional. The caller checks that the eSIM and the EID
+// do not exist yet.
+func createESIM(stub shim.ChaincodeStubInterface, eSIMId string, status string, manufacturer string, eid string, batchId string) error {
+	_, err := transitionESIM(stub, eSIMId, status)
+	if err != nil {
+		return err
+	}
+
+	values := [][2]string{
+		{eSIMKey(eSIMId, "Manufacturer"), manufacturer},
+		{"ESIMByManufacturer" + SEPARATOR + manufacturer + SEPARATOR + eSIMId, eSIMId},
+	}
+	if eid != "" {
+		values = append(values, [2]string{eSIMKey(eSIMId, "EID"), eid}, [2]string{"ESIMByEID" + SEPARATOR + eid, eSIMId})
+	}
+	if batchId != "" {
+		values = append(values, [2]string{eSIMKey(eSIMId, "Batch"), batchId})
+	}
+	for _, value := range values {
+		if err = putState(stub, value[0], []byte(value[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// +--------------------------------------------------------------------------+
+// | resolveESIMId - eSIM id of an ICCID or an EID                            |
+// +--------------------------------------------------------------------------+
+// A valid EID is looked up in the ESIMByEID index, anything else is an ICCID.
+// An unknown EID resolves to itself, which is an unknown eSIM.
+func resolveESIMId(stub shim.ChaincodeStubInterface, id string) (string, error) {
+	if validateEID(id) != nil {
+		return id, nil
+	}
+	eSIMIdBytes, err := stub.GetState("ESIMByEID" + SEPARATOR + id)
+	if err != nil {
+		return "", errorf(ERR_LEDGER, "Failed to get state for EID %s: %s", id, err)
+	}
+	if len(eSIMIdBytes) == 0 {
+		return id, nil
+	}
+	return string(eSIMIdBytes), nil
+}
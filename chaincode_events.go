@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Chaincode events
+// Every invoke that changes the business state sets one event, named after
+// the change, with a ChaincodeEvent JSON payload. The shim keeps a single event
+// per transaction, so when an invoke goes through several changes the last
+// event set describes the whole invoke (a batch provisioning sets
+// ESIMBatchProvisioned rather than one ESIMStateChanged per eSIM).
+const EVENT_SALE_RECORDED string = "SaleRecorded"
+const EVENT_SALE_REFUNDED string = "SaleRefunded"
+const EVENT_INVENTORY_UPDATED string = "InventoryUpdated"
+const EVENT_PRODUCT_CREATED string = "ProductCreated"
+const EVENT_PRODUCT_REMOVED string = "ProductRemoved"
+const EVENT_ESIM_STATE_CHANGED string = "ESIMStateChanged"
+const EVENT_ESIM_BATCH_PROVISIONED string = "ESIMBatchProvisioned"
+const EVENT_ESIM_BOUND string = "ESIMBound"
+const EVENT_ESIM_UNBOUND string = "ESIMUnbound"
+const EVENT_ESIM_TRANSFER_APPROVED string = "ESIMTransferApproved"
+const EVENT_ESIM_TRANSFERRED string = "ESIMTransferred"
+const EVENT_ESIM_TRANSFER_CANCELLED string = "ESIMTransferCancelled"
+const EVENT_ESIM_USAGE_RECORDED string = "ESIMUsageRecorded"
+const EVENT_DATA_PLAN_SET string = "DataPlanSet"
+const EVENT_COMPANY_ADDED string = "CompanyAdded"
+const EVENT_COMPANY_REMOVED string = "CompanyRemoved"
+const EVENT_COMPANY_STATUS_CHANGED string = "CompanyStatusChanged"
+const EVENT_COMPANY_PERCENTAGE_UPDATED string = "CompanyPercentageUpdated"
+const EVENT_BALANCE_ADJUSTED string = "BalanceAdjusted"
+const EVENT_SETTLEMENT_RUN string = "SettlementRun"
+
+// ChaincodeEvent is the payload of every event, Payload depends on the event
+type ChaincodeEvent struct {
+	Event   string      `json:"event"`
+	TxId    string      `json:"txId"`
+	Time    string      `json:"time"`
+	Payload interface{} `json:"payload"`
+}
+
+// CompanyEvent is the payload of the company events
+type CompanyEvent struct {
+	CompanyName    string   `json:"companyName"`
+	Role           string   `json:"role,omitempty"`
+	Status         string   `json:"status,omitempty"`
+	Percentage     *float64 `json:"percentage,omitempty"`
+	InitialBalance float64  `json:"initialBalance,omitempty"`
+}
+
+// InventoryEvent is the payload of InventoryUpdated
+type InventoryEvent struct {
+	EntityId      string `json:"entityId"`
+	LocationId    string `json:"locationId"`
+	ProductId     string `json:"productId"`
+	Delta         int    `json:"delta"`
+	Quantity      int    `json:"quantity"`
+	TotalQuantity int    `json:"totalQuantity"`
+}
+
+// +----------------------------------------------------------------------+
+// | emitEvent - set the chaincode event of the transaction               |
+// +----------------------------------------------------------------------+
+func emitEvent(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	now, err := transactionTime(stub)
+	if err != nil {
+		return err
+	}
+
+	eventBytes, err := json.Marshal(ChaincodeEvent{Event: name, TxId: stub.GetTxID(), Time: formatTime(now), Payload: payload})
+	if err != nil {
+		return err
+	}
+	err = stub.SetEvent(name, eventBytes)
+	if err != nil {
+		return errorf(ERR_LEDGER, "Failed to set %s event: %s", name, err)
+	}
+	return nil
+}
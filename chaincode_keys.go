@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Ledger key namespaces
+// Every attribute of a company, product, eSIM or machine is stored under
+// <Namespace>##<id>##<attribute>. Identifiers cannot contain the separator,
+// so the keys of two different entities can never collide.
+// Ledgers written with the former <id>_<attribute> keys need a fresh deploy.
+const COMPANY_NAMESPACE string = "Company"
+const PRODUCT_NAMESPACE string = "Product"
+const ESIM_NAMESPACE string = "ESIM"
+const MACHINE_NAMESPACE string = "Machine"
+
+// Identifiers are 1 to 64 letters, digits, dots, dashes and underscores
+var ID_PATTERN = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$")
+
+// companyKey is the key of an attribute of a company
+func companyKey(companyName string, attribute string) string {
+	return COMPANY_NAMESPACE + SEPARATOR + companyName + SEPARATOR + attribute
+}
+
+// balanceSnapshotKey is the key of the balance of a company after a transaction
+func balanceSnapshotKey(companyName string, transactionId string) string {
+	return companyKey(companyName, "BalanceAt"+SEPARATOR+transactionId)
+}
+
+// productKey is the key of an attribute of a product
+func productKey(productId string, attribute string) string {
+	return PRODUCT_NAMESPACE + SEPARATOR + productId + SEPARATOR + attribute
+}
+
+// eSIMKey is the key of an attribute of an eSIM
+func eSIMKey(eSIMId string, attribute string) string {
+	return ESIM_NAMESPACE + SEPARATOR + eSIMId + SEPARATOR + attribute
+}
+
+// machineKey is the key of an attribute of a vending machine
+func machineKey(machineId string, attribute string) string {
+	return MACHINE_NAMESPACE + SEPARATOR + machineId + SEPARATOR + attribute
+}
+
+// +-------------------------------------------------------------------+
+// | putState - write a key, failures name the key                     |
+// +-------------------------------------------------------------------+
+func putState(stub shim.ChaincodeStubInterface, key string, value []byte) error {
+	if err := stub.PutState(key, value); err != nil {
+		return ledgerError("put", key, err)
+	}
+	return nil
+}
+
+// +-------------------------------------------------------------------+
+// | delState - delete a key, failures name the key                    |
+// +-------------------------------------------------------------------+
+func delState(stub shim.ChaincodeStubInterface, keys ...string) error {
+	for _, key := range keys {
+		if err := stub.DelState(key); err != nil {
+			return ledgerError("delete", key, err)
+		}
+	}
+	return nil
+}
+
+// +-------------------------------------------------------------------+
+// | validateId - check an identifier against the safe character set   |
+// +-------------------------------------------------------------------+
+// kind names the identifier in the error message
+func validateId(kind string, id string) error {
+	if !ID_PATTERN.MatchString(id) {
+		return newError(ERR_INVALID_ARGS, "Invalid "+kind+" \""+id+"\". Expecting 1 to 64 letters, digits, '.', '-' or '_', starting with a letter or a digit")
+	}
+	return nil
+}
+
+// +-------------------------------------------------------------------+
+// | validateIds - check several identifiers, kind and id pairs         |
+// +-------------------------------------------------------------------+
+func validateIds(kindsAndIds ...string) error {
+	for i := 0; i+1 < len(kindsAndIds); i += 2 {
+		if err := validateId(kindsAndIds[i], kindsAndIds[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// +-------------------------------------------------------------------+
+// | validateICCID - check the format of an ICCID, the eSIM number     |
+// +-------------------------------------------------------------------+
+// An ICCID is 19 or 20 digits, starts with the telecom prefix 89 and ends
+// with a Luhn check digit
+func validateICCID(iccid string) error {
+	if len(iccid) != 19 && len(iccid) != 20 {
+		return newError(ERR_INVALID_ARGS, "Invalid ICCID \""+iccid+"\". Expecting 19 or 20 digits, got "+strconv.Itoa(len(iccid))+" characters")
+	}
+	for i, c := range iccid {
+		if c < '0' || c > '9' {
+			return newError(ERR_INVALID_ARGS, "Invalid ICCID \""+iccid+"\". Non digit character at position "+strconv.Itoa(i+1))
+		}
+	}
+	if iccid[:2] != "89" {
+		return newError(ERR_INVALID_ARGS, "Invalid ICCID \""+iccid+"\". Expecting the telecom prefix 89")
+	}
+	checkDigit := luhnCheckDigit(iccid[:len(iccid)-1])
+	if iccid[len(iccid)-1] != checkDigit {
+		return newError(ERR_INVALID_ARGS, "Invalid ICCID \""+iccid+"\". Wrong check digit "+iccid[len(iccid)-1:]+", expecting "+string(checkDigit))
+	}
+	return nil
+}
+
+// luhnCheckDigit computes the Luhn check digit of a string of digits
+func luhnCheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < len(digits); i++ {
+		digit := int(digits[len(digits)-1-i] - '0')
+		// Every other digit is doubled, starting with the rightmost one
+		if i%2 == 0 {
+			digit = digit * 2
+			if digit > 9 {
+				digit = digit - 9
+			}
+		}
+		sum = sum + digit
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// +-------------------------------------------------------------------+
+// | validateEID - check the format of an EID, the eUICC number        |
+// +-------------------------------------------------------------------+
+// An EID is 32 digits, the last two are check digits: the whole number
+// modulo 97 is 1, as for an IBAN
+func validateEID(eid string) error {
+	if len(eid) != 32 {
+		return newError(ERR_INVALID_ARGS, "Invalid EID \""+eid+"\". Expecting 32 digits, got "+strconv.Itoa(len(eid))+" characters")
+	}
+	for i, c := range eid {
+		if c < '0' || c > '9' {
+			return newError(ERR_INVALID_ARGS, "Invalid EID \""+eid+"\". Non digit character at position "+strconv.Itoa(i+1))
+		}
+	}
+	remainder := 0
+	for i := 0; i < 30; i++ {
+		remainder = (remainder*10 + int(eid[i]-'0')) % 97
+	}
+	checkDigits := fmt.Sprintf("%02d", 98-(remainder*100)%97)
+	if eid[30:] != checkDigits {
+		return newError(ERR_INVALID_ARGS, "Invalid EID \""+eid+"\". Wrong check digits "+eid[30:]+", expecting "+checkDigits)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// testStub is an in-memory ledger whose reads and writes can be made to fail.
+// The shim MockStub provides the methods the chaincode does not use.
+type testStub struct {
+	*shim.MockStub
+	state      map[string][]byte
+	now        time.Time
+	txCount    int
+	attributes map[string]string
+
+	// failures maps an operation (get, put, delete or range) to the key that
+	// fails, a range fails when its start key begins with that key
+	failures map[string]string
+	// writes are the keys put or deleted by the current transaction,
+	// failedAt the number of writes when the injected failure happened
+	writes   []string
+	failedAt int
+	// reads counts the keys returned by the range iterators
+	reads int
+}
+
+func newTestStub() *testStub {
+	return &testStub{
+		MockStub:   shim.NewMockStub("vendingmachine", new(SimpleChaincode)),
+		state:      make(map[string][]byte),
+		now:        time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC),
+		attributes: map[string]string{"role": ADMIN_ROLE, "enrollmentId": "auditor"},
+		failures:   make(map[string]string),
+	}
+}
+
+// begin starts a new transaction, without any failure
+func (stub *testStub) begin() {
+	stub.txCount++
+	stub.writes = nil
+	stub.failedAt = 0
+	stub.failures = make(map[string]string)
+}
+
+// fail returns the injected error of an operation on a key, if any
+func (stub *testStub) fail(operation string, key string) error {
+	failKey, ok := stub.failures[operation]
+	if !ok || (key != failKey && !(operation == "range" && strings.HasPrefix(key, failKey))) {
+		return nil
+	}
+	stub.failedAt = len(stub.writes)
+	return errors.New("injected " + operation + " failure on " + key)
+}
+
+func (stub *testStub) GetTxID() string {
+	return "tx" + strconv.Itoa(stub.txCount)
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now.Unix()}, nil
+}
+
+func (stub *testStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := stub.attributes[attributeName]
+	if !ok {
+		return nil, errors.New("no attribute " + attributeName)
+	}
+	return []byte(value), nil
+}
+
+func (stub *testStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+func (stub *testStub) GetState(key string) ([]byte, error) {
+	if err := stub.fail("get", key); err != nil {
+		return nil, err
+	}
+	return stub.state[key], nil
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	if err := stub.fail("put", key); err != nil {
+		return err
+	}
+	stub.writes = append(stub.writes, key)
+	stub.state[key] = value
+	return nil
+}
+
+func (stub *testStub) DelState(key string) error {
+	if err := stub.fail("delete", key); err != nil {
+		return err
+	}
+	stub.writes = append(stub.writes, key)
+	delete(stub.state, key)
+	return nil
+}
+
+func (stub *testStub) RangeQueryState(startKey string, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	if err := stub.fail("range", startKey); err != nil {
+		return nil, err
+	}
+	// Like the fabric v0.6 iterator: endKey included and the keys in random order
+	iter := &testIterator{stub: stub}
+	for key := range stub.state {
+		if key >= startKey && key <= endKey {
+			iter.keys = append(iter.keys, key)
+		}
+	}
+	return iter, nil
+}
+
+// testIterator iterates over the keys of a range of a testStub
+type testIterator struct {
+	stub *testStub
+	keys []string
+}
+
+func (iter *testIterator) HasNext() bool {
+	return len(iter.keys) > 0
+}
+
+func (iter *testIterator) Next() (string, []byte, error) {
+	key := iter.keys[0]
+	iter.keys = iter.keys[1:]
+	iter.stub.reads++
+	return key, iter.stub.state[key], nil
+}
+
+func (iter *testIterator) Close() error {
+	return nil
+}
+
+// run runs a chaincode function in a new transaction
+func run(stub *testStub, function func(shim.ChaincodeStubInterface, []string) ([]byte, error), args ...string) error {
+	stub.begin()
+	_, err := function(stub, args)
+	return err
+}
+
+// runFailing runs a chaincode function in a new transaction where an operation on a key fails
+func runFailing(stub *testStub, operation string, key string, function func(shim.ChaincodeStubInterface, []string) ([]byte, error), args ...string) error {
+	stub.begin()
+	stub.failures[operation] = key
+	_, err := function(stub, args)
+	return err
+}
+
+// setupSale registers a supplier, a CSP and a VMC and records the sale t1
+func setupSale(t *testing.T) (*SimpleChaincode, *testStub) {
+	cc := new(SimpleChaincode)
+	stub := newTestStub()
+
+	steps := []struct {
+		function func(shim.ChaincodeStubInterface, []string) ([]byte, error)
+		args     []string
+	}{
+		{cc.initLedger, []string{"0"}},
+		{cc.addSupplier, []string{"sup1", "0.2", "0"}},
+		{cc.addCSP, []string{"csp1", "0.1", "0"}},
+		{cc.addVMC, []string{"vmc1", "0"}},
+		{cc.recordTransaction, []string{"t1", "10", "sup1", "csp1", "vmc1", "", "cola"}},
+	}
+	for _, step := range steps {
+		if err := run(stub, step.function, step.args...); err != nil {
+			t.Fatalf("setup failed: %s", err)
+		}
+	}
+	return cc, stub
+}
+
+// expectFailure checks the code of the error, and that nothing was written
+// once the failure happened. Corrupted state is found before any write.
+func expectFailure(t *testing.T, name string, stub *testStub, err error, code string) {
+	if err == nil {
+		t.Errorf("%s: expected a %s error, got none", name, code)
+		return
+	}
+	if toChaincodeError(err).Code != code {
+		t.Errorf("%s: expected a %s error, got %s", name, code, err)
+	}
+	if written := stub.writes[stub.failedAt:]; len(written) > 0 {
+		t.Errorf("%s: wrote %s after the failure", name, strings.Join(written, ", "))
+	}
+}
+
+func TestRecordTransactionCorruptedBalance(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.state[companyKey("sup1", "Balance")] = []byte("not a number")
+
+	err := run(stub, cc.recordTransaction, "t2", "10", "sup1", "csp1", "vmc1", "", "cola")
+	expectFailure(t, "corrupted balance", stub, err, ERR_CORRUPTED_STATE)
+}
+
+func TestInvalidAmounts(t *testing.T) {
+	for _, amount := range []string{"NaN", "Inf", "-Inf", "-10", "0"} {
+		cc, stub := setupSale(t)
+		err := run(stub, cc.recordTransaction, "t2", amount, "sup1", "csp1", "vmc1", "", "cola")
+		expectFailure(t, "sale of "+amount, stub, err, ERR_INVALID_ARGS)
+	}
+	for _, delta := range []string{"NaN", "+Inf"} {
+		cc, stub := setupSale(t)
+		err := run(stub, cc.adjustBalance, "vmc1", delta, "CORRECTION", "ticket-1")
+		expectFailure(t, "adjustment of "+delta, stub, err, ERR_INVALID_ARGS)
+	}
+}
+
+func TestInvalidPercentages(t *testing.T) {
+	cc, stub := setupSale(t)
+	for _, percentage := range []string{"5", "-0.1", "0.9"} {
+		err := run(stub, cc.updatePercentage, "csp1", percentage)
+		expectFailure(t, "CSP percentage "+percentage, stub, err, ERR_INVALID_ARGS)
+	}
+	err := run(stub, cc.addSupplier, "sup2", "0.95", "0")
+	expectFailure(t, "supplier percentage 0.95", stub, err, ERR_INVALID_ARGS)
+
+	stub.state[companyKey("csp1", "Percentage")] = []byte("0.9")
+	err = run(stub, cc.recordTransaction, "t2", "10", "sup1", "csp1", "vmc1", "", "cola")
+	expectFailure(t, "sale with percentages above 1", stub, err, ERR_INVALID_ARGS)
+}
+
+func TestRecordTransactionRequiresBoundMachine(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.state["ESIMByVMC"+SEPARATOR+"vmc1"+SEPARATOR+"e1"] = []byte("e1")
+
+	err := run(stub, cc.recordTransaction, "t2", "10", "sup1", "csp1", "vmc1", "", "cola")
+	expectFailure(t, "sale without the machine id", stub, err, ERR_INVALID_ARGS)
+}
+
+func TestActivateESIMRequiresActiveCSP(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.state[eSIMKey("e1", "Status")] = []byte(ESIM_AVAILABLE)
+
+	err := run(stub, cc.activateESIM, "e1", "csp2", "user1", "iot1", "secret")
+	expectFailure(t, "unknown CSP", stub, err, ERR_NOT_FOUND)
+
+	if err = run(stub, cc.deactivateCompany, "csp1"); err != nil {
+		t.Fatalf("deactivateCompany failed: %s", err)
+	}
+	err = run(stub, cc.activateESIM, "e1", "csp1", "user1", "iot1", "secret")
+	expectFailure(t, "deactivated CSP", stub, err, ERR_INVALID_STATE)
+}
+
+func TestRecordTransactionLedgerFailures(t *testing.T) {
+	failures := [][2]string{
+		{"get", companyKey("csp1", "Percentage")},
+		{"put", companyKey("vmc1", "Balance")},
+		{"put", "Total_Balance"},
+		{"put", "Transactions" + SEPARATOR + "t2"},
+		{"put", "TransactionsByProduct" + SEPARATOR + "cola" + SEPARATOR + "t2"},
+		{"put", "Account" + SEPARATOR + companyAccount("sup1", "RevenueShare")},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		err := runFailing(stub, failure[0], failure[1], cc.recordTransaction, "t2", "10", "sup1", "csp1", "vmc1", "", "cola")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+}
+
+func TestRefundTransactionFailures(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.state["Transactions"+SEPARATOR+"t1"] = []byte("{")
+	err := run(stub, cc.refundTransaction, "t1", "damaged")
+	expectFailure(t, "corrupted transaction", stub, err, ERR_CORRUPTED_STATE)
+
+	failures := [][2]string{
+		{"get", "Refunds" + SEPARATOR + "t1"},
+		{"put", companyKey("csp1", "Balance")},
+		{"put", "Refunds" + SEPARATOR + "t1"},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		err := runFailing(stub, failure[0], failure[1], cc.refundTransaction, "t1", "damaged")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+}
+
+func TestRunSettlementFailures(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.now = stub.now.Add(24 * time.Hour)
+	stub.state[LAST_PERIOD_END_KEY] = []byte("yesterday")
+	err := run(stub, cc.runSettlement, "2024-03-10")
+	expectFailure(t, "corrupted period end", stub, err, ERR_CORRUPTED_STATE)
+
+	failures := [][2]string{
+		{"range", "TransactionsByDate" + SEPARATOR},
+		{"get", "Transactions" + SEPARATOR + "t1"},
+		{"put", companyKey("csp1", "Settled")},
+		{"put", LAST_PERIOD_END_KEY},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		stub.now = stub.now.Add(24 * time.Hour)
+		err := runFailing(stub, failure[0], failure[1], cc.runSettlement, "2024-03-10")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+}
+
+func TestAdjustBalanceFailures(t *testing.T) {
+	cc, stub := setupSale(t)
+	stub.state[companyKey("vmc1", "Balance")] = []byte("not a number")
+	err := run(stub, cc.adjustBalance, "vmc1", "5", "CORRECTION", "ticket-1")
+	expectFailure(t, "corrupted balance", stub, err, ERR_CORRUPTED_STATE)
+
+	failures := [][2]string{
+		{"get", companyKey("vmc1", "Balance")},
+		{"put", companyKey("vmc1", "Balance")},
+		{"put", "Total_Balance"},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		err := runFailing(stub, failure[0], failure[1], cc.adjustBalance, "vmc1", "5", "CORRECTION", "ticket-1")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+
+	cc, stub = setupSale(t)
+	delete(stub.attributes, "role")
+	err = run(stub, cc.adjustBalance, "vmc1", "5", "CORRECTION", "ticket-1")
+	expectFailure(t, "caller without the admin role", stub, err, ERR_UNAUTHORIZED)
+}
+
+func TestAddCompanyLedgerFailures(t *testing.T) {
+	failures := [][2]string{
+		{"put", "Companies" + SEPARATOR + "vmc2"},
+		{"put", companyKey("vmc2", "Balance")},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		err := runFailing(stub, failure[0], failure[1], cc.addVMC, "vmc2", "0")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+}
+
+func TestOpeningBalanceRequiresAdmin(t *testing.T) {
+	cc, stub := setupSale(t)
+	delete(stub.attributes, "role")
+	err := run(stub, cc.addVMC, "vmc2", "1000")
+	expectFailure(t, "opening balance without the admin role", stub, err, ERR_UNAUTHORIZED)
+
+	if err = run(stub, cc.addVMC, "vmc2", "0"); err != nil {
+		t.Errorf("zero opening balance without the admin role: %s", err)
+	}
+}
+
+func TestDataPlanRequiresCSP(t *testing.T) {
+	cc, stub := setupSale(t)
+	delete(stub.attributes, "role")
+	stub.attributes["company"] = "csp2"
+	err := run(stub, cc.setDataPlan, "csp1", "0.5", "1000")
+	expectFailure(t, "data plan set by another company", stub, err, ERR_UNAUTHORIZED)
+
+	stub.attributes["company"] = "csp1"
+	if err = run(stub, cc.setDataPlan, "csp1", "0.5", "1000"); err != nil {
+		t.Errorf("data plan set by the CSP: %s", err)
+	}
+}
+
+func TestUpdateInventoryFailures(t *testing.T) {
+	cc, stub := setupSale(t)
+	totalKey := "InventoryByProduct" + SEPARATOR + "vm1" + SEPARATOR + "cola"
+	stub.state[totalKey] = []byte("many")
+	err := run(stub, cc.updateInventory, "vm1", "A1", "cola", "3")
+	expectFailure(t, "corrupted quantity", stub, err, ERR_CORRUPTED_STATE)
+
+	failures := [][2]string{
+		{"get", totalKey},
+		{"put", totalKey},
+	}
+	for _, failure := range failures {
+		cc, stub := setupSale(t)
+		err := runFailing(stub, failure[0], failure[1], cc.updateInventory, "vm1", "A1", "cola", "3")
+		expectFailure(t, failure[0]+" "+failure[1], stub, err, ERR_LEDGER)
+	}
+}
+
+func TestQueryPageReadsOnePage(t *testing.T) {
+	stub := newTestStub()
+	for i := 0; i < 5000; i++ {
+		stub.state["Journal"+SEPARATOR+strconv.Itoa(100000+i)] = []byte(strconv.Itoa(i))
+	}
+	stub.state["Other"+SEPARATOR+"1"] = []byte("-1")
+
+	paging := Paging{PageSize: 50}
+	next := 0
+	for pages := 0; ; pages++ {
+		stub.reads = 0
+		page, err := queryPage(stub, "Journal"+SEPARATOR, paging, func(key string, value []byte) (json.RawMessage, error) {
+			return json.RawMessage(value), nil
+		})
+		if err != nil {
+			t.Fatalf("page %d: %s", pages, err)
+		}
+		for _, record := range page.Records {
+			if string(record) != strconv.Itoa(next) {
+				t.Fatalf("page %d: expected record %d, got %s", pages, next, record)
+			}
+			next++
+		}
+		if stub.reads > 20*paging.PageSize {
+			t.Errorf("page %d read %d keys", pages, stub.reads)
+		}
+		if page.Bookmark == "" {
+			break
+		}
+		paging.Bookmark = page.Bookmark
+	}
+	if next != 5000 {
+		t.Errorf("expected 5000 records, got %d", next)
+	}
+}
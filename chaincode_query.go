@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Page sizes of the list queries
+const DEFAULT_PAGE_SIZE int = 100
+const MAX_PAGE_SIZE int = 1000
+
+// Page is the response of every paginated list query. Bookmark is the ledger
+// key the next page starts from, empty when there are no more records.
+// A page covers pageSize ledger keys, so a filtered query can return fewer
+// records than pageSize and still have a bookmark.
+type Page struct {
+	Records  []json.RawMessage `json:"records"`
+	Bookmark string            `json:"bookmark"`
+}
+
+// Paging holds the pageSize= and bookmark= arguments of a list query
+type Paging struct {
+	PageSize int
+	Bookmark string
+}
+
+// +-----------------------------------------------------------------------+
+// | parseFilters - parse the name=value filter arguments of a list query |
+// +-----------------------------------------------------------------------+
+func parseFilters(args []string, allowed ...string) (map[string]string, error) {
+	filters := make(map[string]string)
+
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			return nil, newError(ERR_INVALID_ARGS, "Invalid filter "+arg+". Expecting name=value")
+		}
+		name := arg[0:i]
+		value := strings.TrimSpace(arg[i+1:])
+
+		known := false
+		for _, a := range allowed {
+			if a == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, newError(ERR_INVALID_ARGS, "Unknown filter "+name+". Expecting one of "+strings.Join(allowed, ", "))
+		}
+		if _, ok := filters[name]; ok {
+			return nil, newError(ERR_INVALID_ARGS, "Duplicate filter "+name)
+		}
+		filters[name] = value
+	}
+
+	return filters, nil
+}
+
+// +---------------------------------------------------------------------+
+// | splitList - split a comma separated list, dropping the empty items |
+// +---------------------------------------------------------------------+
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// +----------------------------------------------------------------------------+
+// | parsePaging - read the pageSize and bookmark filters of a list query       |
+// +----------------------------------------------------------------------------+
+func parsePaging(filters map[string]string) (Paging, error) {
+	var paging Paging
+	var err error
+
+	paging.PageSize = DEFAULT_PAGE_SIZE
+	if size, ok := filters["pageSize"]; ok {
+		paging.PageSize, err = strconv.Atoi(size)
+		if err != nil || paging.PageSize <= 0 || paging.PageSize > MAX_PAGE_SIZE {
+			return paging, errorf(ERR_INVALID_ARGS, "Invalid pageSize %s. Expecting a number between 1 and %d", size, MAX_PAGE_SIZE)
+		}
+	}
+	paging.Bookmark = filters["bookmark"]
+
+	return paging, nil
+}
+
+// +----------------------------------------------------------------------------+
+// | queryPage - read one page of the keys starting with prefix                 |
+// +----------------------------------------------------------------------------+
+// The keys are visited in lexical order starting at the bookmark, so that the
+// pages are stable whatever order the range iterator returns the keys in.
+// visit converts a key/value pair to a record, or returns nil to skip it.
+func queryPage(stub shim.ChaincodeStubInterface, prefix string, paging Paging, visit func(key string, value []byte) (json.RawMessage, error)) (Page, error) {
+	return queryRangePage(stub, prefix, prefix, prefix+"}", paging, visit)
+}
+
+// +----------------------------------------------------------------------------+
+// | queryRangePage - read one page of the keys between startKey and endKey     |
+// +----------------------------------------------------------------------------+
+// All the keys of the range must start with prefix, bookmarks outside of the
+// prefix are rejected. endKey itself is never part of the page.
+// The fabric v0.6 range iterator returns the keys in random order, so a range
+// cannot be cut after its first keys. Each RangeQueryState stops after
+// pageSize+1 keys instead: when the range holds more, it is split at the median
+// of the keys read and the left part is read first. The keys read are a random
+// sample, so a split halves the range and a page costs a few reads of
+// pageSize+1 keys, whatever the length of the range.
+func queryRangePage(stub shim.ChaincodeStubInterface, prefix string, startKey string, endKey string, paging Paging, visit func(key string, value []byte) (json.RawMessage, error)) (Page, error) {
+	var page Page
+	var keys []string
+
+	if paging.Bookmark != "" {
+		if !strings.HasPrefix(paging.Bookmark, prefix) || paging.Bookmark < startKey {
+			return page, newError(ERR_INVALID_ARGS, "Invalid bookmark "+paging.Bookmark)
+		}
+		startKey = paging.Bookmark
+	}
+
+	// ranges is a stack of the parts left to read, the leftmost part on top
+	limit := paging.PageSize + 1
+	values := make(map[string][]byte)
+	ranges := [][2]string{{startKey, endKey}}
+	for len(ranges) > 0 && len(keys) < limit {
+		part := ranges[len(ranges)-1]
+		ranges = ranges[:len(ranges)-1]
+
+		partKeys, complete, err := readRange(stub, prefix, part[0], part[1], limit-len(keys), values)
+		if err != nil {
+			return page, err
+		}
+		if !complete {
+			// The median is above the first key read, so both parts are smaller
+			middle := partKeys[len(partKeys)/2]
+			ranges = append(ranges, [2]string{middle, part[1]}, [2]string{part[0], middle})
+			continue
+		}
+		keys = append(keys, partKeys...)
+	}
+
+	page.Records = []json.RawMessage{}
+	for i, key := range keys {
+		if i == paging.PageSize {
+			page.Bookmark = key
+			break
+		}
+		record, err := visit(key, values[key])
+		if err != nil {
+			return page, err
+		}
+		if record != nil {
+			page.Records = append(page.Records, record)
+		}
+	}
+
+	return page, nil
+}
+
+// +----------------------------------------------------------------------------+
+// | readRange - read the keys from startKey to endKey, endKey excluded         |
+// +----------------------------------------------------------------------------+
+// Stops after limit+1 keys. complete is true when the range holds at most limit
+// keys, their values are then stored in values. Otherwise the limit+1 keys read
+// are returned, without their values. The keys are in lexical order.
+func readRange(stub shim.ChaincodeStubInterface, prefix string, startKey string, endKey string, limit int, values map[string][]byte) ([]string, bool, error) {
+	var keys []string
+
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		return nil, false, errorf(ERR_LEDGER, "RangeQueryState failed for %s: %s", prefix, err)
+	}
+	defer iter.Close()
+
+	read := make(map[string][]byte)
+	for iter.HasNext() && len(keys) <= limit {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, false, errorf(ERR_LEDGER, "iter.Next() failed for %s: %s", prefix, err)
+		}
+		// The iterator includes endKey
+		if key < startKey || key >= endKey {
+			continue
+		}
+		keys = append(keys, key)
+		read[key] = value
+	}
+	sort.Strings(keys)
+
+	if len(keys) > limit {
+		return keys, false, nil
+	}
+	for key, value := range read {
+		values[key] = value
+	}
+	return keys, true, nil
+}
+
+// +----------------------------------------------------------------------------+
+// | scanPrefix - visit all the keys starting with prefix in lexical order      |
+// +----------------------------------------------------------------------------+
+// For the queries and invokes that need a whole range rather than a page.
+// The keys are sorted because the range iterator returns them in random order.
+func scanPrefix(stub shim.ChaincodeStubInterface, prefix string, visit func(key string, value []byte) error) error {
+	var keys []string
+
+	iter, err := stub.RangeQueryState(prefix, prefix+"}")
+	if err != nil {
+		return errorf(ERR_LEDGER, "RangeQueryState failed for %s: %s", prefix, err)
+	}
+	defer iter.Close()
+
+	values := make(map[string][]byte)
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return errorf(ERR_LEDGER, "iter.Next() failed for %s: %s", prefix, err)
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err = visit(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
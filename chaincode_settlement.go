@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Settlement keys
+// - Company##<company>##Balance is the accrued balance, the earnings not settled yet
+// - Company##<company>##Settled is the settled balance, the total of the issued statements
+// - Settlements##<company>##<periodEnd>##<settlementId> is a settlement statement
+// - Settlement_LastPeriodEnd is the end of the last settled period
+const LAST_PERIOD_END_KEY string = "Settlement_LastPeriodEnd"
+
+// SettlementStatement is the payout statement issued to a company by a settlement run
+type SettlementStatement struct {
+	SettlementId     string   `json:"settlementId"`
+	CompanyName      string   `json:"companyName"`
+	PeriodStart      string   `json:"periodStart"`
+	PeriodEnd        string   `json:"periodEnd"`
+	Amount           float64  `json:"amount"`
+	TransactionCount int      `json:"transactionCount"`
+	TransactionIds   []string `json:"transactionIds"`
+	UsageIds         []string `json:"usageIds,omitempty"`
+	IssuedAt         string   `json:"issuedAt"`
+}
+
+// +------------------------------------------------------------------------------+
+// | runSettlement - invoke function to settle the earnings of a period           |
+// | Params - periodEnd                                                           |
+// +------------------------------------------------------------------------------+
+// The period starts after the end of the last settlement run. Every company with
+// earnings from the transactions or eSIM usage charges of the period gets a
+// statement, and the amount moves from its accrued balance to its settled balance.
+// Restricted to the admin role.
+func (t *SimpleChaincode) runSettlement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var periodStart, periodEnd, now time.Time
+	var settlementId string
+	var err error
+
+	fmt.Println("running runSettlement()")
+
+	_, err = checkAdmin(stub, "runSettlement")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1. Period end")
+	}
+
+	periodEnd, dateOnly, err := parseDate(args[0])
+	if err != nil {
+		return nil, err
+	}
+	// A date without time settles the whole day
+	if dateOnly {
+		periodEnd = periodEnd.Add(24*time.Hour - time.Second)
+	}
+
+	now, err = transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	if periodEnd.After(now) {
+		return nil, newError(ERR_INVALID_ARGS, "Cannot settle a period ending in the future: "+formatTime(periodEnd))
+	}
+
+	lastPeriodEndBytes, err := stub.GetState(LAST_PERIOD_END_KEY)
+	if err != nil {
+		return nil, ledgerError("get", LAST_PERIOD_END_KEY, err)
+	}
+	if len(lastPeriodEndBytes) > 0 {
+		periodStart, _, err = parseDate(string(lastPeriodEndBytes))
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted %s: %s", LAST_PERIOD_END_KEY, toChaincodeError(err).Message)
+		}
+		if !periodEnd.After(periodStart) {
+			return nil, newError(ERR_CONFLICT, "Period already settled up to "+formatTime(periodStart))
+		}
+	}
+
+	// Collect the shares of the transactions and usage charges of the period, by company
+	statements := make(map[string]*SettlementStatement)
+	settlementId = stub.GetTxID()
+	statementOf := func(companyName string) *SettlementStatement {
+		statement, ok := statements[companyName]
+		if !ok {
+			statement = &SettlementStatement{
+				SettlementId:   settlementId,
+				CompanyName:    companyName,
+				PeriodEnd:      formatTime(periodEnd),
+				TransactionIds: []string{},
+				IssuedAt:       formatTime(now),
+			}
+			if !periodStart.IsZero() {
+				statement.PeriodStart = formatTime(periodStart)
+			}
+			statements[companyName] = statement
+		}
+		return statement
+	}
+
+	prefix := "TransactionsByDate" + SEPARATOR
+	startKey := prefix
+	if !periodStart.IsZero() {
+		startKey = prefix + periodStart.Format(DATE_BUCKET_LAYOUT)
+	}
+	iter, err := stub.RangeQueryState(startKey, prefix+periodEnd.Format(DATE_BUCKET_LAYOUT)+SEPARATOR+"}")
+	if err != nil {
+		return nil, errorf(ERR_LEDGER, "runSettlement RangeQueryState failed: %s", err)
+	}
+	defer iter.Close()
+
+	// The amounts are summed in key order so that every peer computes the same totals
+	var transactionIds []string
+	for iter.HasNext() {
+		_, transactionIdBytes, err := iter.Next()
+		if err != nil {
+			return nil, errorf(ERR_LEDGER, "runSettlement iter.Next() failed: %s", err)
+		}
+		transactionIds = append(transactionIds, string(transactionIdBytes))
+	}
+	sort.Strings(transactionIds)
+
+	for _, transactionId := range transactionIds {
+		var transaction Transaction
+
+		transactionBytes, err := stub.GetState("Transactions" + SEPARATOR + transactionId)
+		if err != nil {
+			return nil, errorf(ERR_LEDGER, "Failed to get state for transaction %s: %s", transactionId, err)
+		}
+		if len(transactionBytes) == 0 {
+			continue
+		}
+		if err = json.Unmarshal(transactionBytes, &transaction); err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted transaction record %s: %s", transactionId, err)
+		}
+
+		date, _, err := parseDate(transaction.Date)
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted date of transaction %s: %s", transactionId, toChaincodeError(err).Message)
+		}
+		if date.After(periodEnd) || (!periodStart.IsZero() && !date.After(periodStart)) {
+			continue
+		}
+		refundBytes, err := stub.GetState("Refunds" + SEPARATOR + transactionId)
+		if err != nil {
+			return nil, errorf(ERR_LEDGER, "Failed to get state for refund %s: %s", transactionId, err)
+		}
+		if len(refundBytes) > 0 {
+			continue
+		}
+		if len(transaction.Shares) == 0 {
+			// Recorded before the shares were stored, cannot be settled automatically
+			fmt.Println("runSettlement skipped transaction without shares: " + transaction.TransactionId)
+			continue
+		}
+
+		for _, share := range transaction.Shares {
+			statement := statementOf(share.CompanyName)
+			statement.Amount = statement.Amount + share.Amount
+			statement.TransactionCount++
+			statement.TransactionIds = append(statement.TransactionIds, transaction.TransactionId)
+		}
+	}
+
+	// Usage charges of the period, format UsageByDate##Date##UsageId##eSIMId
+	var usageKeys []string
+	prefix = "UsageByDate" + SEPARATOR
+	startKey = prefix
+	if !periodStart.IsZero() {
+		startKey = prefix + periodStart.Format(DATE_BUCKET_LAYOUT)
+	}
+	usageIter, err := stub.RangeQueryState(startKey, prefix+periodEnd.Format(DATE_BUCKET_LAYOUT)+SEPARATOR+"}")
+	if err != nil {
+		return nil, errorf(ERR_LEDGER, "runSettlement RangeQueryState failed: %s", err)
+	}
+	defer usageIter.Close()
+	for usageIter.HasNext() {
+		_, usageKeyBytes, err := usageIter.Next()
+		if err != nil {
+			return nil, errorf(ERR_LEDGER, "runSettlement iter.Next() failed: %s", err)
+		}
+		usageKeys = append(usageKeys, string(usageKeyBytes))
+	}
+	sort.Strings(usageKeys)
+
+	for _, usageKey := range usageKeys {
+		var usage ESIMUsage
+
+		usageBytes, err := stub.GetState(usageKey)
+		if err != nil {
+			return nil, ledgerError("get", usageKey, err)
+		}
+		if len(usageBytes) == 0 {
+			continue
+		}
+		if err = json.Unmarshal(usageBytes, &usage); err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted usage record %s: %s", usageKey, err)
+		}
+		date, _, err := parseDate(usage.Time)
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted time of usage %s: %s", usageKey, toChaincodeError(err).Message)
+		}
+		if date.After(periodEnd) || (!periodStart.IsZero() && !date.After(periodStart)) || usage.Charge == 0 {
+			continue
+		}
+		for _, share := range usage.Shares {
+			statement := statementOf(share.CompanyName)
+			statement.Amount = statement.Amount + share.Amount
+			statement.UsageIds = append(statement.UsageIds, usage.UsageId)
+		}
+	}
+
+	// Companies are processed in a fixed order so that every peer writes the same state
+	companies := make([]string, 0, len(statements))
+	for companyName := range statements {
+		companies = append(companies, companyName)
+	}
+	sort.Strings(companies)
+
+	for _, companyName := range companies {
+		statement := statements[companyName]
+		sort.Strings(statement.TransactionIds)
+		sort.Strings(statement.UsageIds)
+
+		key := "Settlements" + SEPARATOR + companyName + SEPARATOR + statement.PeriodEnd + SEPARATOR + settlementId
+		existing, err := stub.GetState(key)
+		if err != nil {
+			return nil, ledgerError("get", key, err)
+		}
+		if len(existing) > 0 {
+			return nil, newError(ERR_CONFLICT, "Settlement statement already issued: "+key)
+		}
+
+		statementBytes, err := json.Marshal(statement)
+		if err != nil {
+			return nil, err
+		}
+		if err = putState(stub, key, statementBytes); err != nil {
+			return nil, err
+		}
+
+		if _, err = changeBalance(stub, companyName, -statement.Amount, "Settlement", settlementId); err != nil {
+			return nil, err
+		}
+		if _, err = addToBalance(stub, companyKey(companyName, "Settled"), statement.Amount); err != nil {
+			return nil, err
+		}
+		err = postJournalEntry(stub, "Settlement", companyName, transfer(companyAccount(companyName, "RevenueShare"), companyAccount(companyName, "Payable"), statement.Amount))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("runSettlement issued statement " + key + " for " + strconv.FormatFloat(statement.Amount, 'f', -1, 64))
+	}
+
+	err = putState(stub, LAST_PERIOD_END_KEY, []byte(formatTime(periodEnd)))
+	if err != nil {
+		return nil, err
+	}
+
+	settled := struct {
+		SettlementId string                `json:"settlementId"`
+		PeriodEnd    string                `json:"periodEnd"`
+		Statements   []SettlementStatement `json:"statements"`
+	}{settlementId, formatTime(periodEnd), []SettlementStatement{}}
+	for _, companyName := range companies {
+		settled.Statements = append(settled.Statements, *statements[companyName])
+	}
+	err = emitEvent(stub, EVENT_SETTLEMENT_RUN, settled)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// +------------------------------------------------------------------------------+
+// | getSettlementStatements - query function to list the statements of a company |
+// | Params - companyName, optional pageSize=, bookmark=                          |
+// +------------------------------------------------------------------------------+
+func (t *SimpleChaincode) getSettlementStatements(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var companyName string
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting name of the company, followed by optional pageSize= and bookmark=")
+	}
+
+	companyName = args[0]
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Statements are listed by period end
+	page, err = queryPage(stub, "Settlements"+SEPARATOR+companyName+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getSettlementStatements failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// +-----------------------------------------------------------------------------+
+// | getSettledBalance - query function to read the settled balance of a company |
+// +-----------------------------------------------------------------------------+
+// Fails with NOT_FOUND for unknown companies, companies never settled have 0
+func (t *SimpleChaincode) getSettledBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var key string
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting name of the company to get the settled balance")
+	}
+
+	key = companyKey(args[0], "Settled")
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ledgerError("get", key, err)
+	}
+	if len(valAsbytes) > 0 {
+		return valAsbytes, nil
+	}
+
+	balanceBytes, err := stub.GetState(companyKey(args[0], "Balance"))
+	if err != nil {
+		return nil, ledgerError("get", companyKey(args[0], "Balance"), err)
+	}
+	if len(balanceBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown company "+args[0], "companyName", args[0])
+	}
+	return []byte("0"), nil
+}
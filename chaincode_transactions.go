@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Transaction is the record stored under Transactions##<transactionId>
+type Transaction struct {
+	TransactionId string           `json:"transactionId"`
+	Amount        string           `json:"amount"`
+	Date          string           `json:"Date"`
+	ProductName   string           `json:"ProductName"`
+	SupplierName  string           `json:"SupplierName"`
+	CSPName       string           `json:"CSPName"`
+	VMCName       string           `json:"VMCName"`
+	DeviceTime    string           `json:"deviceTime,omitempty"`
+	MachineId     string           `json:"machineId,omitempty"`
+	ESIMId        string           `json:"eSIMId,omitempty"`
+	Balances      []CompanyBalance `json:"balances"`
+	Shares        []CompanyShare   `json:"shares,omitempty"`
+}
+
+// CompanyBalance is the balance of a company after a transaction
+type CompanyBalance struct {
+	CompanyName string  `json:"companyName"`
+	Balance     float64 `json:"balance"`
+}
+
+// CompanyShare is the amount of a transaction credited to a company
+type CompanyShare struct {
+	CompanyName string  `json:"companyName"`
+	Role        string  `json:"role"`
+	Amount      float64 `json:"amount"`
+}
+
+// Date formats accepted for transaction dates and date filters
+var DATE_LAYOUTS = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// Layout of the date buckets of the TransactionsByDate index
+const DATE_BUCKET_LAYOUT string = "2006-01-02"
+
+// +--------------------------------------------------------------+
+// | parseDate - parse a date in one of the accepted date formats |
+// +--------------------------------------------------------------+
+// dateOnly is true when the value has no time of day
+func parseDate(value string) (date time.Time, dateOnly bool, err error) {
+	for _, layout := range DATE_LAYOUTS {
+		date, err = time.Parse(layout, value)
+		if err == nil {
+			return date.UTC(), layout == DATE_BUCKET_LAYOUT, nil
+		}
+	}
+	return date, false, newError(ERR_INVALID_ARGS, "Invalid date "+value+". Expecting RFC 3339 or YYYY-MM-DD")
+}
+
+// +---------------------------------------------------------------------+
+// | transactionTime - timestamp of the ledger transaction being executed |
+// +---------------------------------------------------------------------+
+// This is the authoritative time of everything recorded by the chaincode,
+// client supplied dates are only informative.
+func transactionTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errorf(ERR_LEDGER, "Failed to get the transaction timestamp: %s", err)
+	}
+	if timestamp == nil {
+		return time.Time{}, newError(ERR_LEDGER, "Failed to get the transaction timestamp")
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// +------------------------------------------------------+
+// | formatTime - format a time as stored in the ledger   |
+// +------------------------------------------------------+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// +----------------------------------------------------------------------+
+// | transactionIndexKeys - secondary index keys written for a transaction |
+// +----------------------------------------------------------------------+
+// Format TransactionsBy<Index>##<Value>##<TransactionId>, the value is the transaction id.
+// The machine index only holds the sales of a known machine, and the date
+// bucket is left out when the transaction date cannot be parsed.
+func transactionIndexKeys(transaction Transaction) []string {
+	var keys []string
+
+	suffix := SEPARATOR + transaction.TransactionId
+	keys = append(keys, "TransactionsByCompany"+SEPARATOR+transaction.SupplierName+suffix)
+	if transaction.CSPName != transaction.SupplierName {
+		keys = append(keys, "TransactionsByCompany"+SEPARATOR+transaction.CSPName+suffix)
+	}
+	if transaction.VMCName != transaction.SupplierName && transaction.VMCName != transaction.CSPName {
+		keys = append(keys, "TransactionsByCompany"+SEPARATOR+transaction.VMCName+suffix)
+	}
+	if transaction.MachineId != "" {
+		keys = append(keys, "TransactionsByMachine"+SEPARATOR+transaction.MachineId+suffix)
+	}
+	keys = append(keys, "TransactionsByProduct"+SEPARATOR+transaction.ProductName+suffix)
+
+	date, _, err := parseDate(transaction.Date)
+	if err == nil {
+		keys = append(keys, "TransactionsByDate"+SEPARATOR+date.Format(DATE_BUCKET_LAYOUT)+suffix)
+	}
+
+	return keys
+}
+
+// +-------------------------------------------------------------------------------+
+// | searchTransactions - query function to search the transactions with filters  |
+// | Params - optional filters: company=, supplier=, csp=, vmc=, machine=,        |
+// |          product=, from=, to=, pageSize=, bookmark=                          |
+// +-------------------------------------------------------------------------------+
+// The most selective filter picks the index that is ranged over, the other
+// filters are applied to the transaction records. from and to are inclusive.
+// A bookmark is only valid with the same filters as the query that returned it.
+func (t *SimpleChaincode) searchTransactions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var from, to time.Time
+	var prefix, startKey, endKey string
+	var err error
+
+	fmt.Println("running searchTransactions()")
+
+	filters, err = parseFilters(args, "company", "supplier", "csp", "vmc", "machine", "product", "from", "to", "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := filters["from"]; ok {
+		from, _, err = parseDate(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := filters["to"]; ok {
+		var dateOnly bool
+		to, dateOnly, err = parseDate(value)
+		if err != nil {
+			return nil, err
+		}
+		// A date without time includes the whole day
+		if dateOnly {
+			to = to.Add(24*time.Hour - time.Nanosecond)
+		}
+	}
+
+	// Pick the index to range over
+	if machine, ok := filters["machine"]; ok {
+		prefix = "TransactionsByMachine" + SEPARATOR + machine + SEPARATOR
+	} else if vmc, ok := filters["vmc"]; ok {
+		prefix = "TransactionsByCompany" + SEPARATOR + vmc + SEPARATOR
+	} else if supplier, ok := filters["supplier"]; ok {
+		prefix = "TransactionsByCompany" + SEPARATOR + supplier + SEPARATOR
+	} else if csp, ok := filters["csp"]; ok {
+		prefix = "TransactionsByCompany" + SEPARATOR + csp + SEPARATOR
+	} else if company, ok := filters["company"]; ok {
+		prefix = "TransactionsByCompany" + SEPARATOR + company + SEPARATOR
+	} else if product, ok := filters["product"]; ok {
+		prefix = "TransactionsByProduct" + SEPARATOR + product + SEPARATOR
+	} else if !from.IsZero() || !to.IsZero() {
+		prefix = "TransactionsByDate" + SEPARATOR
+	} else {
+		prefix = "Transactions" + SEPARATOR
+	}
+	startKey = prefix
+	endKey = prefix + "}"
+	if prefix == "TransactionsByDate"+SEPARATOR {
+		if !from.IsZero() {
+			startKey = prefix + from.Format(DATE_BUCKET_LAYOUT)
+		}
+		if !to.IsZero() {
+			endKey = prefix + to.Format(DATE_BUCKET_LAYOUT) + SEPARATOR + "}"
+		}
+	}
+
+	page, err = queryRangePage(stub, prefix, startKey, endKey, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		var transaction Transaction
+
+		transactionBytes := value
+		if prefix != "Transactions"+SEPARATOR {
+			// Index entries hold the transaction id
+			transactionBytes, err = stub.GetState("Transactions" + SEPARATOR + string(value))
+			if err != nil {
+				return nil, errorf(ERR_LEDGER, "Failed to get state for transaction %s: %s", string(value), err)
+			}
+			if len(transactionBytes) == 0 {
+				return nil, nil
+			}
+		}
+		if err := json.Unmarshal(transactionBytes, &transaction); err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted transaction record %s: %s", ledgerKey, err)
+		}
+
+		if !transaction.matches(filters, from, to) {
+			return nil, nil
+		}
+		return json.RawMessage(transactionBytes), nil
+	})
+	if err != nil {
+		return nil, wrapError("searchTransactions failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// matches checks the transaction against the filters of searchTransactions
+func (tr Transaction) matches(filters map[string]string, from time.Time, to time.Time) bool {
+	if company, ok := filters["company"]; ok && company != tr.SupplierName && company != tr.CSPName && company != tr.VMCName {
+		return false
+	}
+	if supplier, ok := filters["supplier"]; ok && supplier != tr.SupplierName {
+		return false
+	}
+	if csp, ok := filters["csp"]; ok && csp != tr.CSPName {
+		return false
+	}
+	if vmc, ok := filters["vmc"]; ok && vmc != tr.VMCName {
+		return false
+	}
+	if machine, ok := filters["machine"]; ok && machine != tr.MachineId {
+		return false
+	}
+	if product, ok := filters["product"]; ok && product != tr.ProductName {
+		return false
+	}
+
+	if !from.IsZero() || !to.IsZero() {
+		// Transactions without a valid date never match a date range
+		date, _, err := parseDate(tr.Date)
+		if err != nil {
+			return false
+		}
+		if !from.IsZero() && date.Before(from) {
+			return false
+		}
+		if !to.IsZero() && date.After(to) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Refund is the record stored under Refunds##<transactionId>
+type Refund struct {
+	TransactionId string         `json:"transactionId"`
+	RefundId      string         `json:"refundId"`
+	Amount        float64        `json:"amount"`
+	Reason        string         `json:"reason"`
+	Actor         string         `json:"actor"`
+	Time          string         `json:"time"`
+	Shares        []CompanyShare `json:"shares"`
+}
+
+// +-------------------------------------------------------------------------------+
+// | refundTransaction - invoke function to refund a sale and reverse its shares   |
+// | Params - transactionId, reason                                                |
+// +-------------------------------------------------------------------------------+
+// Only transactions of the unsettled period can be refunded, settled sales are
+// corrected with adjustBalance. Restricted to the admin role, the actor of the
+// refund is the enrollment id of the caller.
+func (t *SimpleChaincode) refundTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transactionId, reason string
+	var transaction Transaction
+	var refund Refund
+	var err error
+
+	fmt.Println("running refundTransaction()")
+
+	refund.Actor, err = checkAdmin(stub, "refundTransaction")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2. Transaction Id and reason")
+	}
+
+	transactionId = args[0]
+	reason = args[1]
+	if reason == "" {
+		return nil, newError(ERR_INVALID_ARGS, "Missing reason of the refund")
+	}
+
+	transactionBytes, err := stub.GetState("Transactions" + SEPARATOR + transactionId)
+	if err != nil {
+		return nil, ledgerError("get", "Transactions"+SEPARATOR+transactionId, err)
+	}
+	if len(transactionBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown transaction "+transactionId, "transactionId", transactionId)
+	}
+	if err = json.Unmarshal(transactionBytes, &transaction); err != nil {
+		return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted transaction record %s: %s", transactionId, err)
+	}
+	if len(transaction.Shares) == 0 {
+		return nil, newError(ERR_INVALID_STATE, "Transaction "+transactionId+" has no recorded shares and cannot be refunded. Use adjustBalance")
+	}
+
+	refundBytes, err := stub.GetState("Refunds" + SEPARATOR + transactionId)
+	if err != nil {
+		return nil, ledgerError("get", "Refunds"+SEPARATOR+transactionId, err)
+	}
+	if len(refundBytes) > 0 {
+		return nil, newError(ERR_CONFLICT, "Transaction "+transactionId+" is already refunded")
+	}
+
+	lastPeriodEndBytes, err := stub.GetState(LAST_PERIOD_END_KEY)
+	if err != nil {
+		return nil, ledgerError("get", LAST_PERIOD_END_KEY, err)
+	}
+	if len(lastPeriodEndBytes) > 0 {
+		date, _, err := parseDate(transaction.Date)
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted date of transaction %s: %s", transactionId, toChaincodeError(err).Message)
+		}
+		lastPeriodEnd, _, err := parseDate(string(lastPeriodEndBytes))
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted %s: %s", LAST_PERIOD_END_KEY, toChaincodeError(err).Message)
+		}
+		if !date.After(lastPeriodEnd) {
+			return nil, newError(ERR_INVALID_STATE, "Transaction "+transactionId+" belongs to a settled period. Use adjustBalance")
+		}
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	refund.TransactionId = transactionId
+	refund.RefundId = stub.GetTxID()
+	refund.Reason = reason
+	refund.Time = formatTime(now)
+	refund.Shares = transaction.Shares
+
+	// Reverse the shares of every company and the total
+	lines := []JournalLine{}
+	for _, share := range transaction.Shares {
+		if _, err = changeBalance(stub, share.CompanyName, -share.Amount, "Refund", transactionId); err != nil {
+			return nil, err
+		}
+		refund.Amount = refund.Amount + share.Amount
+		lines = append(lines, JournalLine{Account: companyAccount(share.CompanyName, "RevenueShare"), Debit: share.Amount})
+	}
+	if _, err = addToBalance(stub, "Total_Balance", -refund.Amount); err != nil {
+		return nil, err
+	}
+	lines = append(lines, JournalLine{Account: CASH_ACCOUNT, Credit: refund.Amount})
+	if err = postJournalEntry(stub, "Refund", transactionId, lines); err != nil {
+		return nil, err
+	}
+
+	refundBytes, err = json.Marshal(refund)
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, "Refunds"+SEPARATOR+transactionId, refundBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_SALE_REFUNDED, refund)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// eSIM transfers between CSPs
+// - ESIM##<eSIMId>##PendingTransfer is the transfer waiting for the approval of the other CSP
+// - ESIMTransfers##<eSIMId>##<effectiveAt>##<txId> is a completed transfer
+// The losing and the gaining CSP must both call transferESIM, in any order. The
+// second call switches the CSP binding, the end user and IoT credentials are kept.
+
+// ESIMTransfer is a transfer of an eSIM from a CSP to another one
+type ESIMTransfer struct {
+	ESIMId      string   `json:"eSIMId"`
+	FromCSP     string   `json:"fromCSP"`
+	ToCSP       string   `json:"toCSP"`
+	ApprovedBy  []string `json:"approvedBy"`
+	RequestedAt string   `json:"requestedAt"`
+	EffectiveAt string   `json:"effectiveAt,omitempty"`
+	TxId        string   `json:"txId,omitempty"`
+}
+
+// ESIMTransferCancellation is the payload of ESIMTransferCancelled
+type ESIMTransferCancellation struct {
+	ESIMTransfer
+	CancelledBy string `json:"cancelledBy"`
+}
+
+// +--------------------------------------------------------------------------+
+// | transferESIM - invoke function to approve the transfer of an eSIM        |
+// | Params - eSIMId, toCSP                                                   |
+// +--------------------------------------------------------------------------+
+// The caller must be the losing or the gaining CSP, from the company attribute
+// of its certificate.
+func (t *SimpleChaincode) transferESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transfer ESIMTransfer
+	var eSIMId, toCSP string
+
+	fmt.Println("running transferESIM()")
+
+	if len(args) != 2 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2. eSIM id and gaining CSP")
+	}
+
+	eSIMId = args[0]
+	toCSP = args[1]
+
+	eSIM, found, err := getESIMRecord(stub, eSIMId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown eSIM "+eSIMId, "eSIMId", eSIMId)
+	}
+	if eSIM.Status != ESIM_ACTIVE && eSIM.Status != ESIM_SUSPENDED {
+		return nil, newError(ERR_INVALID_STATE, "Cannot transfer eSIM "+eSIMId+" in state "+eSIM.Status+". Expecting "+ESIM_ACTIVE+" or "+ESIM_SUSPENDED)
+	}
+	if toCSP == eSIM.CSPName {
+		return nil, newError(ERR_CONFLICT, "eSIM "+eSIMId+" is already bound to "+toCSP)
+	}
+
+	if err = checkCompanyActive(stub, toCSP, "CSP"); err != nil {
+		return nil, err
+	}
+
+	caller, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != eSIM.CSPName && caller != toCSP {
+		return nil, newError(ERR_UNAUTHORIZED, "Only "+eSIM.CSPName+" and "+toCSP+" can approve the transfer of eSIM "+eSIMId)
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingBytes, err := stub.GetState(eSIMKey(eSIMId, "PendingTransfer"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(eSIMId, "PendingTransfer"), err)
+	}
+	if len(pendingBytes) > 0 {
+		if err = json.Unmarshal(pendingBytes, &transfer); err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted pending transfer of eSIM %s: %s", eSIMId, err)
+		}
+		if transfer.FromCSP != eSIM.CSPName || transfer.ToCSP != toCSP {
+			return nil, newError(ERR_CONFLICT, "eSIM "+eSIMId+" already has a pending transfer from "+transfer.FromCSP+" to "+transfer.ToCSP+". Cancel it first")
+		}
+		if containsString(transfer.ApprovedBy, caller) {
+			return nil, newError(ERR_CONFLICT, "Transfer of eSIM "+eSIMId+" already approved by "+caller)
+		}
+	} else {
+		transfer.ESIMId = eSIMId
+		transfer.FromCSP = eSIM.CSPName
+		transfer.ToCSP = toCSP
+		transfer.RequestedAt = formatTime(now)
+	}
+	transfer.ApprovedBy = append(transfer.ApprovedBy, caller)
+
+	// Waiting for the other CSP
+	if len(transfer.ApprovedBy) < 2 {
+		transferBytes, err := json.Marshal(transfer)
+		if err != nil {
+			return nil, err
+		}
+		err = putState(stub, eSIMKey(eSIMId, "PendingTransfer"), transferBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = emitEvent(stub, EVENT_ESIM_TRANSFER_APPROVED, transfer)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	// Both CSPs approved, switch the binding
+	transfer.EffectiveAt = formatTime(now)
+	transfer.TxId = stub.GetTxID()
+
+	err = delState(stub, "ESIMByCSP"+SEPARATOR+transfer.FromCSP+SEPARATOR+eSIMId)
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, "ESIMByCSP"+SEPARATOR+transfer.ToCSP+SEPARATOR+eSIMId, []byte(eSIMId))
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, eSIMKey(eSIMId, "CSP"), []byte(transfer.ToCSP))
+	if err != nil {
+		return nil, err
+	}
+	err = delState(stub, eSIMKey(eSIMId, "PendingTransfer"))
+	if err != nil {
+		return nil, err
+	}
+
+	transferBytes, err := json.Marshal(transfer)
+	if err != nil {
+		return nil, err
+	}
+	key := "ESIMTransfers" + SEPARATOR + eSIMId + SEPARATOR + transfer.EffectiveAt + SEPARATOR + transfer.TxId
+	err = putState(stub, key, transferBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_ESIM_TRANSFERRED, transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("eSIM " + eSIMId + " transferred from " + transfer.FromCSP + " to " + transfer.ToCSP)
+	return nil, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | cancelESIMTransfer - invoke function to withdraw a pending transfer      |
+// | Params - eSIMId                                                          |
+// +--------------------------------------------------------------------------+
+// Either CSP of the transfer can cancel it
+func (t *SimpleChaincode) cancelESIMTransfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transfer ESIMTransfer
+
+	fmt.Println("running cancelESIMTransfer()")
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	pendingBytes, err := stub.GetState(eSIMKey(args[0], "PendingTransfer"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(args[0], "PendingTransfer"), err)
+	}
+	if len(pendingBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "eSIM "+args[0]+" has no pending transfer")
+	}
+	if err = json.Unmarshal(pendingBytes, &transfer); err != nil {
+		return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted pending transfer of eSIM %s: %s", args[0], err)
+	}
+
+	caller, err := callerCompany(stub)
+	if err != nil {
+		return nil, err
+	}
+	if caller != transfer.FromCSP && caller != transfer.ToCSP {
+		return nil, newError(ERR_UNAUTHORIZED, "Only "+transfer.FromCSP+" and "+transfer.ToCSP+" can cancel the transfer of eSIM "+args[0])
+	}
+
+	err = delState(stub, eSIMKey(args[0], "PendingTransfer"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_ESIM_TRANSFER_CANCELLED, ESIMTransferCancellation{ESIMTransfer: transfer, CancelledBy: caller})
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// +--------------------------------------------------------------------------+
+// | getESIMTransfers - query function to list the transfers of an eSIM       |
+// | Params - eSIMId, optional pageSize=, bookmark=                           |
+// +--------------------------------------------------------------------------+
+// The completed transfers are listed by effective date, followed by the pending
+// transfer if there is one.
+func (t *SimpleChaincode) getESIMTransfers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var transfers struct {
+		Page
+		Pending json.RawMessage `json:"pending,omitempty"`
+	}
+	var filters map[string]string
+	var paging Paging
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting eSIM id, followed by optional pageSize= and bookmark=")
+	}
+
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers.Page, err = queryPage(stub, "ESIMTransfers"+SEPARATOR+args[0]+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getESIMTransfers failed", err)
+	}
+
+	pendingBytes, err := stub.GetState(eSIMKey(args[0], "PendingTransfer"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(args[0], "PendingTransfer"), err)
+	}
+	if len(pendingBytes) > 0 {
+		transfers.Pending = json.RawMessage(pendingBytes)
+	}
+
+	return json.Marshal(transfers)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// eSIM data usage
+// - Company##<CSP>##DataPlan is the data plan of a CSP
+// - ESIM##<eSIMId>##Usage##<period> is the number of bytes used by an eSIM in a period
+// - ESIMUsage##<eSIMId>##<period>##<time>##<txId> is a usage record
+// - UsageByPeriod##<period>##<eSIMId>##<time>##<txId> and
+//   UsageByDate##<date>##<txId>##<eSIMId> index the usage records, the value is the record key
+// Usage is charged to the VMC operating the machine of the eSIM and credited
+// to the CSP of the eSIM. The charges are settled with the sales.
+
+// Layout of the usage periods
+const USAGE_PERIOD_LAYOUT string = "2006-01"
+
+// Bytes in a megabyte of a data plan
+const BYTES_PER_MB float64 = 1000000
+
+// DataPlan is the rating of the data used by the eSIMs of a CSP. The first
+// IncludedBytes of every period are free, the rest costs PricePerMB.
+type DataPlan struct {
+	CSPName       string  `json:"CSPName"`
+	PricePerMB    float64 `json:"pricePerMB"`
+	IncludedBytes int64   `json:"includedBytes"`
+}
+
+// ESIMUsage is a usage record and its charge
+type ESIMUsage struct {
+	UsageId       string         `json:"usageId"`
+	ESIMId        string         `json:"eSIMId"`
+	Period        string         `json:"period"`
+	Bytes         int64          `json:"bytes"`
+	PeriodBytes   int64          `json:"periodBytes"`
+	BillableBytes int64          `json:"billableBytes"`
+	Charge        float64        `json:"charge"`
+	CSPName       string         `json:"CSPName"`
+	VMCName       string         `json:"VMCName"`
+	MachineId     string         `json:"machineId"`
+	Time          string         `json:"time"`
+	Shares        []CompanyShare `json:"shares"`
+}
+
+// +------------------------------------------------------------------------+
+// | setDataPlan - invoke function to set the data plan of a CSP            |
+// | Params - CSPName, pricePerMB, includedBytes                            |
+// +------------------------------------------------------------------------+
+// Restricted to the CSP itself and the admin role.
+func (t *SimpleChaincode) setDataPlan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var plan DataPlan
+	var err error
+
+	fmt.Println("running setDataPlan()")
+
+	if len(args) != 3 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3. CSP name, price per MB and included bytes")
+	}
+
+	plan.CSPName = args[0]
+	company, found, err := getCompany(stub, plan.CSPName)
+	if err != nil {
+		return nil, err
+	}
+	if !found || company.Role != "CSP" {
+		return nil, newError(ERR_NOT_FOUND, "Unknown CSP "+plan.CSPName, "companyName", plan.CSPName)
+	}
+	if err = checkCompanyCaller(stub, plan.CSPName, "setDataPlan"); err != nil {
+		return nil, err
+	}
+
+	plan.PricePerMB, err = parseAmount("price per MB", args[1])
+	if err != nil || plan.PricePerMB < 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid price per MB "+args[1]+". Expecting a positive number")
+	}
+	plan.IncludedBytes, err = strconv.ParseInt(args[2], 10, 64)
+	if err != nil || plan.IncludedBytes < 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid included bytes "+args[2]+". Expecting a positive integer")
+	}
+
+	planBytes, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, companyKey(plan.CSPName, "DataPlan"), planBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_DATA_PLAN_SET, plan)
+	if err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// +------------------------------------------------------------------------+
+// | getDataPlan - query function to read the data plan of a CSP            |
+// | Params - CSPName                                                       |
+// +------------------------------------------------------------------------+
+// Fails with NOT_FOUND when the CSP has no data plan
+func (t *SimpleChaincode) getDataPlan(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
+	}
+
+	planBytes, err := stub.GetState(companyKey(args[0], "DataPlan"))
+	if err != nil {
+		return nil, ledgerError("get", companyKey(args[0], "DataPlan"), err)
+	}
+	if len(planBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "CSP "+args[0]+" has no data plan", "companyName", args[0])
+	}
+
+	return planBytes, nil
+}
+
+// +------------------------------------------------------------------------+
+// | recordESIMUsage - invoke function to rate and charge eSIM data usage   |
+// | Params - eSIMId, bytes, period                                         |
+// +------------------------------------------------------------------------+
+// period is a month, YYYY-MM. The usage is added to the bytes of the period and
+// only the bytes above the allowance of the plan of the CSP are charged.
+// Restricted to the current CSP of the eSIM and the admin role.
+func (t *SimpleChaincode) recordESIMUsage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var usage ESIMUsage
+	var plan DataPlan
+	var err error
+
+	fmt.Println("running recordESIMUsage()")
+
+	if len(args) != 3 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3. eSIM id, bytes and period")
+	}
+
+	usage.ESIMId = args[0]
+	usage.Bytes, err = strconv.ParseInt(args[1], 10, 64)
+	if err != nil || usage.Bytes <= 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid bytes "+args[1]+". Expecting a positive integer")
+	}
+	if _, err = time.Parse(USAGE_PERIOD_LAYOUT, args[2]); err != nil {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid period "+args[2]+". Expecting YYYY-MM")
+	}
+	usage.Period = args[2]
+
+	eSIM, found, err := getESIMRecord(stub, usage.ESIMId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown eSIM "+usage.ESIMId, "eSIMId", usage.ESIMId)
+	}
+	if eSIM.MachineId == "" {
+		return nil, newError(ERR_INVALID_STATE, "eSIM "+usage.ESIMId+" is not bound to a machine, there is no VMC to charge")
+	}
+	usage.CSPName = eSIM.CSPName
+	usage.VMCName = eSIM.VMCName
+	usage.MachineId = eSIM.MachineId
+	if err = checkCompanyCaller(stub, usage.CSPName, "recordESIMUsage"); err != nil {
+		return nil, err
+	}
+	if err = checkCompanyActive(stub, usage.CSPName, "CSP"); err != nil {
+		return nil, err
+	}
+	if err = checkCompanyActive(stub, usage.VMCName, "VMC"); err != nil {
+		return nil, err
+	}
+
+	planBytes, err := stub.GetState(companyKey(usage.CSPName, "DataPlan"))
+	if err != nil {
+		return nil, ledgerError("get", companyKey(usage.CSPName, "DataPlan"), err)
+	}
+	if len(planBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "CSP "+usage.CSPName+" has no data plan")
+	}
+	if err = json.Unmarshal(planBytes, &plan); err != nil {
+		return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted data plan of %s: %s", usage.CSPName, err)
+	}
+
+	// Rate the bytes above the allowance, before and after this usage
+	periodKey := eSIMKey(usage.ESIMId, "Usage"+SEPARATOR+usage.Period)
+	periodBytes, err := stub.GetState(periodKey)
+	if err != nil {
+		return nil, ledgerError("get", periodKey, err)
+	}
+	var before int64
+	if len(periodBytes) > 0 {
+		before, err = strconv.ParseInt(string(periodBytes), 10, 64)
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted usage %s: %s", periodKey, err)
+		}
+	}
+	usage.PeriodBytes = before + usage.Bytes
+	usage.BillableBytes = billableBytes(usage.PeriodBytes, plan.IncludedBytes) - billableBytes(before, plan.IncludedBytes)
+	usage.Charge = float64(usage.BillableBytes) / BYTES_PER_MB * plan.PricePerMB
+	usage.Shares = []CompanyShare{
+		{CompanyName: usage.VMCName, Role: "VMC", Amount: -usage.Charge},
+		{CompanyName: usage.CSPName, Role: "CSP", Amount: usage.Charge},
+	}
+
+	now, err := transactionTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	usage.UsageId = stub.GetTxID()
+	usage.Time = formatTime(now)
+
+	err = putState(stub, periodKey, []byte(strconv.FormatInt(usage.PeriodBytes, 10)))
+	if err != nil {
+		return nil, err
+	}
+
+	if usage.Charge != 0 {
+		for _, share := range usage.Shares {
+			if _, err = changeBalance(stub, share.CompanyName, share.Amount, "Usage", usage.UsageId); err != nil {
+				return nil, err
+			}
+		}
+		err = postJournalEntry(stub, "Usage", usage.UsageId, transfer(companyAccount(usage.VMCName, "RevenueShare"), companyAccount(usage.CSPName, "RevenueShare"), usage.Charge))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	usageBytes, err := json.Marshal(usage)
+	if err != nil {
+		return nil, err
+	}
+	key := "ESIMUsage" + SEPARATOR + usage.ESIMId + SEPARATOR + usage.Period + SEPARATOR + usage.Time + SEPARATOR + usage.UsageId
+	err = putState(stub, key, usageBytes)
+	if err != nil {
+		return nil, err
+	}
+	indexKeys := []string{
+		"UsageByPeriod" + SEPARATOR + usage.Period + SEPARATOR + usage.ESIMId + SEPARATOR + usage.Time + SEPARATOR + usage.UsageId,
+		"UsageByDate" + SEPARATOR + now.Format(DATE_BUCKET_LAYOUT) + SEPARATOR + usage.UsageId + SEPARATOR + usage.ESIMId,
+	}
+	for _, indexKey := range indexKeys {
+		if err = putState(stub, indexKey, []byte(key)); err != nil {
+			return nil, err
+		}
+	}
+
+	err = emitEvent(stub, EVENT_ESIM_USAGE_RECORDED, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// billableBytes is the part of the bytes of a period above the allowance
+func billableBytes(periodBytes int64, includedBytes int64) int64 {
+	if periodBytes <= includedBytes {
+		return 0
+	}
+	return periodBytes - includedBytes
+}
+
+// +---------------------------------------------------------------------------+
+// | getESIMUsage - query function to list the usage records of an eSIM        |
+// | Params - eSIMId, optional period=, pageSize=, bookmark=                   |
+// +---------------------------------------------------------------------------+
+func (t *SimpleChaincode) getESIMUsage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var prefix string
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting eSIM id, followed by optional period=, pageSize= and bookmark=")
+	}
+
+	filters, err = parseFilters(args[1:], "period", "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	prefix = "ESIMUsage" + SEPARATOR + args[0] + SEPARATOR
+	if period, ok := filters["period"]; ok {
+		prefix = prefix + period + SEPARATOR
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err = queryPage(stub, prefix, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		return json.RawMessage(value), nil
+	})
+	if err != nil {
+		return nil, wrapError("getESIMUsage failed", err)
+	}
+
+	return json.Marshal(page)
+}
+
+// +---------------------------------------------------------------------------+
+// | getUsageByPeriod - query function to list the usage records of a period   |
+// | Params - period, optional pageSize=, bookmark=                            |
+// +---------------------------------------------------------------------------+
+func (t *SimpleChaincode) getUsageByPeriod(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting period, followed by optional pageSize= and bookmark=")
+	}
+
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index entries hold the key of the usage record
+	page, err = queryPage(stub, "UsageByPeriod"+SEPARATOR+args[0]+SEPARATOR, paging, func(ledgerKey string, value []byte) (json.RawMessage, error) {
+		usageBytes, err := stub.GetState(string(value))
+		if err != nil {
+			return nil, ledgerError("get", string(value), err)
+		}
+		if len(usageBytes) == 0 {
+			return nil, nil
+		}
+		return json.RawMessage(usageBytes), nil
+	})
+	if err != nil {
+		return nil, wrapError("getUsageByPeriod failed", err)
+	}
+
+	return json.Marshal(page)
+}
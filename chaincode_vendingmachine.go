@@ -1,12 +1,11 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	//"golang.org/pkg/strconv"
 	"strconv"
 	"strings"
-	//"encoding/json"
+	"encoding/json"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -19,6 +18,28 @@ type SimpleChaincode struct {
 //	Product []string `json:"product"`
 //}
 
+// Product is a catalog entry as returned by the product and inventory queries
+type Product struct {
+	ProductId     string            `json:"productId"`
+	Entity        string            `json:"relatedEntity"`
+	ProductName   string            `json:"productName"`
+	ProductImg    string            `json:"productImg"`
+	ProductPrice  string            `json:"productPrice"`
+	ProductQRCode string            `json:"productQRCode"`
+	Category      string            `json:"category"`
+	Tags          []string          `json:"tags"`
+	Allergens     []string          `json:"allergens"`
+	Nutrition     map[string]string `json:"nutrition"`
+}
+
+// InventoryItem is a product stocked in a vending machine
+type InventoryItem struct {
+	EntityId   string `json:"entityId,omitempty"`
+	LocationId string `json:"locationId,omitempty"`
+	Quantity   string `json:"quantity"`
+	Product
+}
+
 // Separator
 const SEPARATOR string = "##"
 
@@ -36,11 +57,41 @@ func main() {
 // | Init resets all the things |
 // +----------------------------+
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	result, err := t.initLedger(stub, args)
+	if err != nil {
+		return nil, toChaincodeError(err)
+	}
+	return result, nil
+}
+
+// +--------------------------------------------------------------+
+// | initLedger - set the initial balance, called by Init         |
+// +--------------------------------------------------------------+
+// Only reachable at deployment, Invoke does not dispatch init
+func (t *SimpleChaincode) initLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1. Initial Balance")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1. Initial Balance")
+	}
+
+	initialBalance, err := parseAmount("initial balance", args[0])
+	if err != nil {
+		return nil, err
+	}
+	currentBalance, err := readBalance(stub, "Total_Balance")
+	if err != nil {
+		return nil, err
+	}
+
+	err = putState(stub, "Total_Balance", []byte(args[0]))
+	if err != nil {
+		return nil, err
 	}
 
-	stub.PutState("Total_Balance", []byte(args[0]))
+	// Keep the cash account in line with the new Total_Balance
+	err = postJournalEntry(stub, "Opening", "Total_Balance", transfer(CASH_ACCOUNT, EQUITY_ACCOUNT, initialBalance-currentBalance))
+	if err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
@@ -51,13 +102,25 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 // +----------------------------------------------------------+
 // | Invoke is our entry point to invoke a chaincode function |
 // +----------------------------------------------------------+
+// Every error reaches the client as a serialized ChaincodeError
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	result, err := t.invoke(stub, function, args)
+	if err != nil {
+		return nil, toChaincodeError(err)
+	}
+	return result, nil
+}
+
+// +----------------------------------------------------------+
+// | invoke - dispatch an invocation to its function          |
+// +----------------------------------------------------------+
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("invoke is running " + function)
 
 	// Handle different functions
-	if function == "init" {
-		return t.Init(stub, "init", args)
-	} else if function == "addVMC" {
+	// init is not dispatched: resetting Total_Balance outside of the deployment
+	// would bypass the audited balance adjustments
+	if function == "addVMC" {
 		return t.addVMC(stub, args)
 	} else if function == "removeVMC" {
 		return t.removeVMC(stub, args)
@@ -69,53 +132,125 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 		return t.addSupplier(stub, args)
 	} else if function == "removeSupplier" {
 		return t.removeSupplier(stub, args)
-	} else if function == "resetBalance" {
-		return t.resetBalance(stub, args)
+	} else if function == "adjustBalance" {
+		return t.adjustBalance(stub, args)
+	} else if function == "deactivateCompany" {
+		return t.deactivateCompany(stub, args)
+	} else if function == "reactivateCompany" {
+		return t.reactivateCompany(stub, args)
 	} else if function == "updatePercentage" {
 		return t.updatePercentage(stub, args)
 	} else if function == "recordTransaction" {
 		return t.recordTransaction(stub, args)
 	} else if function == "addESIM" {
 		return t.addESIM(stub, args)
+	} else if function == "provisionESIMBatch" {
+		return t.provisionESIMBatch(stub, args)
 	} else if function == "activateESIM" {
 		return t.activateESIM(stub, args)
 	} else if function == "removeESIM" {
 		return t.removeESIM(stub, args)
 	} else if function == "deactivateESIM" {
 		return t.deactivateESIM(stub, args)
+	} else if function == "makeESIMAvailable" {
+		return t.makeESIMAvailable(stub, args)
+	} else if function == "suspendESIM" {
+		return t.suspendESIM(stub, args)
+	} else if function == "resumeESIM" {
+		return t.resumeESIM(stub, args)
+	} else if function == "bindESIM" {
+		return t.bindESIM(stub, args)
+	} else if function == "unbindESIM" {
+		return t.unbindESIM(stub, args)
+	} else if function == "transferESIM" {
+		return t.transferESIM(stub, args)
+	} else if function == "cancelESIMTransfer" {
+		return t.cancelESIMTransfer(stub, args)
+	} else if function == "setDataPlan" {
+		return t.setDataPlan(stub, args)
+	} else if function == "recordESIMUsage" {
+		return t.recordESIMUsage(stub, args)
 	} else if function == "createProduct" {
 		return t.createProduct(stub, args)
 	} else if function == "removeProduct" {
 		return t.removeProduct(stub, args)
 	} else if function == "updateInventory" {
 		return t.updateInventory(stub, args)
+	} else if function == "refundTransaction" {
+		return t.refundTransaction(stub, args)
+	} else if function == "runSettlement" {
+		return t.runSettlement(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation: " + function)
+	return nil, newError(ERR_INVALID_ARGS, "Received unknown function invocation: "+function)
 }
 
-// +---------------------------------------------------------+
-// | createProduct - invoke function to create a new Product |
-// +---------------------------------------------------------+
+// +----------------------------------------------------------------------------+
+// | createProduct - invoke function to create a new Product                    |
+// | Params - productId, entityId, name, image, price, QRCode                   |
+// |          [category, tags, allergens, nutrition]                            |
+// +----------------------------------------------------------------------------+
 func (t *SimpleChaincode) createProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var productId, productName, productImg, productPrice, productQRCode, entityId string
-	
+	var category, tags, allergens, nutrition string
+
+	if len(args) != 6 && len(args) != 10 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 6, or 10 with category, tags, allergens and nutrition")
+	}
+
 	productId = args[0]
 	entityId = args[1]
 	productName = args[2]
 	productImg = args[3]
 	productPrice = args[4]
 	productQRCode = args[5]
-	
+
+	err := validateIds("product id", productId, "entity id", entityId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional catalog attributes
+	// Tags and allergens are comma separated lists, nutrition is a JSON object
+	if len(args) == 10 {
+		category = strings.TrimSpace(args[6])
+		tags = strings.Join(splitList(args[7]), ",")
+		allergens = strings.Join(splitList(args[8]), ",")
+		nutrition = strings.TrimSpace(args[9])
+		if nutrition != "" {
+			var facts map[string]string
+			if err := json.Unmarshal([]byte(nutrition), &facts); err != nil {
+				return nil, newError(ERR_INVALID_ARGS, "Invalid nutrition attributes, expecting a JSON object of strings: "+err.Error())
+			}
+		}
+	}
+
 	// Create all the key/value pairs in the ledger
 	// The first key is necessary to list all the products
-	stub.PutState("Product_" + productId, []byte(productId))
-	stub.PutState(productId + "_Entity", []byte(entityId))
-	stub.PutState(productId + "_Name", []byte(productName))
-	stub.PutState(productId + "_Image", []byte(productImg))
-	stub.PutState(productId + "_Price", []byte(productPrice))
-	stub.PutState(productId + "_QRCode", []byte(productQRCode))
+	attributes := [][2]string{
+		{"Products" + SEPARATOR + productId, productId},
+		{productKey(productId, "Entity"), entityId},
+		{productKey(productId, "Name"), productName},
+		{productKey(productId, "Image"), productImg},
+		{productKey(productId, "Price"), productPrice},
+		{productKey(productId, "QRCode"), productQRCode},
+		{productKey(productId, "Category"), category},
+		{productKey(productId, "Tags"), tags},
+		{productKey(productId, "Allergens"), allergens},
+		{productKey(productId, "Nutrition"), nutrition},
+	}
+	for _, attribute := range attributes {
+		if err = putState(stub, attribute[0], []byte(attribute[1])); err != nil {
+			return nil, err
+		}
+	}
+
+	err = emitEvent(stub, EVENT_PRODUCT_CREATED, Product{ProductId: productId, Entity: entityId, ProductName: productName, ProductImg: productImg,
+		ProductPrice: productPrice, ProductQRCode: productQRCode, Category: category, Tags: splitList(tags), Allergens: splitList(allergens)})
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running createProduct()")
 
@@ -134,18 +269,33 @@ func (t *SimpleChaincode) removeProduct(stub shim.ChaincodeStubInterface, args [
 	var productId string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	productId = args[0]
 
+	// The Products index lists the products of the catalog
+	key := "Products" + SEPARATOR + productId
+	indexBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ledgerError("get", key, err)
+	}
+	if len(indexBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown product "+productId, "productId", productId)
+	}
+
 	// Delete all the key/value pairs to the ledger
-	stub.DelState("Product_" + productId)
-	stub.DelState(productId + "_Entity")
-	stub.DelState(productId + "_Name")
-	stub.DelState(productId + "_Image")
-	stub.DelState(productId + "_Price")
-	stub.DelState(productId + "_QRCode")
+	err = delState(stub, key, productKey(productId, "Entity"), productKey(productId, "Name"),
+		productKey(productId, "Image"), productKey(productId, "Price"), productKey(productId, "QRCode"), productKey(productId, "Category"),
+		productKey(productId, "Tags"), productKey(productId, "Allergens"), productKey(productId, "Nutrition"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_PRODUCT_REMOVED, Product{ProductId: productId})
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running removeProduct()")
 
@@ -168,58 +318,96 @@ func (t *SimpleChaincode) updateInventory(stub shim.ChaincodeStubInterface, args
 	currentTotalQuantity = 0
 
 	fmt.Println("running updateInventory()")
+
+	if len(args) != 4 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 4. Entity id, location id, product id and quantity")
+	}
 	
 	entityId = args[0]
 	locationId = args[1]
 	productId = args[2]
 	quantityString = args[3]
+
+	err = validateIds("entity id", entityId, "location id", locationId, "product id", productId)
+	if err != nil {
+		return nil, err
+	}
 	
 	// Can be positive (add to inventory) or negative (remove from inventory)
 	deltaQuantity, err := strconv.Atoi(quantityString)
+	if err != nil {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid quantity "+quantityString+". Expecting an integer")
+	}
 
 	// Retrieve current quantity for this location and product
 	// Check if there is an existing quantity
-	currentQuantityBytes, err := stub.GetState("InventoryByLocation" + SEPARATOR + entityId + SEPARATOR + locationId + SEPARATOR + productId);
-	//if err != nil {
+	locationKey := "InventoryByLocation" + SEPARATOR + entityId + SEPARATOR + locationId + SEPARATOR + productId
+	currentQuantityBytes, err := stub.GetState(locationKey)
+	if err != nil {
+		return nil, ledgerError("get", locationKey, err)
+	}
 	if len(currentQuantityBytes) <= 0 {
 		// No current quantity
-		// Would need to check if deltaQuantity is positive
 		newQuantity = deltaQuantity
 	} else {
 		// Product is already in this location
 		currentQuantity, err = strconv.Atoi(string(currentQuantityBytes))
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted quantity %s: %s", locationKey, err)
+		}
 		newQuantity = currentQuantity + deltaQuantity
 	}
 	
 	// Do the same for total quantity
-	currentTotalQuantityBytes, err := stub.GetState("InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId);
-	//if err != nil {
+	totalKey := "InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId
+	currentTotalQuantityBytes, err := stub.GetState(totalKey)
+	if err != nil {
+		return nil, ledgerError("get", totalKey, err)
+	}
 	if len(currentTotalQuantityBytes) <= 0 {
 		// No total quantity
-		// Would need to check if deltaQuantity is positive
 		newTotalQuantity = deltaQuantity
 	} else {
 		// Product is already in this location
 		currentTotalQuantity, err = strconv.Atoi(string(currentTotalQuantityBytes))
+		if err != nil {
+			return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted quantity %s: %s", totalKey, err)
+		}
 		newTotalQuantity = currentTotalQuantity + deltaQuantity
 	}
 	
+	// Cannot remove more than the location holds
+	if newQuantity < 0 {
+		return nil, newError(ERR_INSUFFICIENT_STOCK, "Insufficient stock of product "+productId+" at location "+locationId+" of "+entityId,
+			"entityId", entityId, "locationId", locationId, "productId", productId,
+			"available", strconv.Itoa(currentQuantity), "requested", strconv.Itoa(-deltaQuantity))
+	}
+
 	// Store the quantities back to the ledger or delete the entry if new quantity is zero
 	// Delete the entry if the new quantity is zero
 	if newQuantity <= 0 {
-		stub.DelState("InventoryByLocation" + SEPARATOR + entityId + SEPARATOR + locationId + SEPARATOR + productId);
+		err = delState(stub, locationKey)
 	} else {
-		stub.PutState("InventoryByLocation" + SEPARATOR + entityId + SEPARATOR + locationId + SEPARATOR + productId, []byte(strconv.Itoa(newQuantity)))
+		err = putState(stub, locationKey, []byte(strconv.Itoa(newQuantity)))
+	}
+	if err != nil {
+		return nil, err
 	}
 	// Delete the entry if the new quantity is zero
 	if newTotalQuantity <= 0 {
-		stub.DelState("InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId);
+		err = delState(stub, totalKey)
 	} else {
-		stub.PutState("InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId, []byte(strconv.Itoa(newTotalQuantity)))
+		err = putState(stub, totalKey, []byte(strconv.Itoa(newTotalQuantity)))
 	}
 	if err != nil {
 		return nil, err
 	}
+
+	err = emitEvent(stub, EVENT_INVENTORY_UPDATED, InventoryEvent{EntityId: entityId, LocationId: locationId, ProductId: productId,
+		Delta: deltaQuantity, Quantity: newQuantity, TotalQuantity: newTotalQuantity})
+	if err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
 
@@ -232,20 +420,36 @@ func (t *SimpleChaincode) addVMC(stub shim.ChaincodeStubInterface, args []string
 	var err error
 	
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2")
 	}
 	
 	VMCName = args[0]
-	initialBalance, err = strconv.ParseFloat(args[1], 64)
+	err = validateId("VMC name", VMCName)
+	if err != nil {
+		return nil, err
+	}
+	initialBalance, err = parseAmount("initial balance", args[1])
+	if err != nil {
+		return nil, err
+	}
 
 	// Create all the key/value pairs to the ledger
-	stub.PutState(VMCName + "_Balance", []byte(strconv.FormatFloat(initialBalance, 'f', -1, 64)))
-
-	fmt.Println("running addVMC()")
+	err = openBalance(stub, VMCName, initialBalance, "addVMC")
+	if err != nil {
+		return nil, err
+	}
+	err = registerCompany(stub, VMCName, "VMC")
+	if err != nil {
+		return nil, err
+	}
 
+	err = emitEvent(stub, EVENT_COMPANY_ADDED, CompanyEvent{CompanyName: VMCName, Role: "VMC", Status: COMPANY_ACTIVE, InitialBalance: initialBalance})
 	if err != nil {
 		return nil, err
 	}
+
+	fmt.Println("running addVMC()")
+
 	return nil, nil
 }
 
@@ -256,13 +460,27 @@ func (t *SimpleChaincode) removeVMC(stub shim.ChaincodeStubInterface, args []str
 	var VMCName string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	VMCName = args[0]
 
+	// Refuse to remove a company that is still in use
+	err := checkCompanyRemovable(stub, VMCName, "VMC")
+	if err != nil {
+		return nil, err
+	}
+
 	// Delete all the key/value pairs from the ledger
-	stub.DelState(VMCName + "_Balance")
+	err = delState(stub, "Companies"+SEPARATOR+VMCName, companyKey(VMCName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_COMPANY_REMOVED, CompanyEvent{CompanyName: VMCName, Role: "VMC"})
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running removeVMC()")
 
@@ -278,22 +496,48 @@ func (t *SimpleChaincode) addCSP(stub shim.ChaincodeStubInterface, args []string
 	var err error
 	
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3")
 	}
 	
 	CSPName = args[0]
-	percentage, err = strconv.ParseFloat(args[1], 64)
-	initialBalance, err = strconv.ParseFloat(args[2], 64)
+	err = validateId("CSP name", CSPName)
+	if err != nil {
+		return nil, err
+	}
+	percentage, err = parseAmount("percentage", args[1])
+	if err != nil {
+		return nil, err
+	}
+	initialBalance, err = parseAmount("initial balance", args[2])
+	if err != nil {
+		return nil, err
+	}
+	err = checkPercentage(stub, CSPName, "CSP", percentage)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create all the key/value pairs to the ledger
-	stub.PutState(CSPName + "_Percentage", []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
-	stub.PutState(CSPName + "_Balance", []byte(strconv.FormatFloat(initialBalance, 'f', -1, 64)))
-
-	fmt.Println("running addCSP()")
+	err = openBalance(stub, CSPName, initialBalance, "addCSP")
+	if err != nil {
+		return nil, err
+	}
+	err = registerCompany(stub, CSPName, "CSP")
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, companyKey(CSPName, "Percentage"), []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
+	if err != nil {
+		return nil, err
+	}
 
+	err = emitEvent(stub, EVENT_COMPANY_ADDED, CompanyEvent{CompanyName: CSPName, Role: "CSP", Status: COMPANY_ACTIVE, Percentage: &percentage, InitialBalance: initialBalance})
 	if err != nil {
 		return nil, err
 	}
+
+	fmt.Println("running addCSP()")
+
 	return nil, nil
 }
 
@@ -304,14 +548,27 @@ func (t *SimpleChaincode) removeCSP(stub shim.ChaincodeStubInterface, args []str
 	var CSPName string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	CSPName = args[0]
 
+	// Refuse to remove a company that is still in use
+	err := checkCompanyRemovable(stub, CSPName, "CSP")
+	if err != nil {
+		return nil, err
+	}
+
 	// Delete all the key/value pairs from the ledger
-	stub.DelState(CSPName + "_Percentage")
-	stub.DelState(CSPName + "_Balance")
+	err = delState(stub, "Companies"+SEPARATOR+CSPName, companyKey(CSPName, "Percentage"), companyKey(CSPName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitEvent(stub, EVENT_COMPANY_REMOVED, CompanyEvent{CompanyName: CSPName, Role: "CSP"})
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running removeCSP()")
 
@@ -327,22 +584,48 @@ func (t *SimpleChaincode) addSupplier(stub shim.ChaincodeStubInterface, args []s
 	var err error
 	
 	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3")
 	}
 	
 	supplierName = args[0]
-	percentage, err = strconv.ParseFloat(args[1], 64)
-	initialBalance, err = strconv.ParseFloat(args[2], 64)
+	err = validateId("supplier name", supplierName)
+	if err != nil {
+		return nil, err
+	}
+	percentage, err = parseAmount("percentage", args[1])
+	if err != nil {
+		return nil, err
+	}
+	initialBalance, err = parseAmount("initial balance", args[2])
+	if err != nil {
+		return nil, err
+	}
+	err = checkPercentage(stub, supplierName, "Supplier", percentage)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create all the key/value pairs to the ledger
-	stub.PutState(supplierName + "_Percentage", []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
-	stub.PutState(supplierName + "_Balance", []byte(strconv.FormatFloat(initialBalance, 'f', -1, 64)))
-
-	fmt.Println("running addSupplier()")
+	err = openBalance(stub, supplierName, initialBalance, "addSupplier")
+	if err != nil {
+		return nil, err
+	}
+	err = registerCompany(stub, supplierName, "Supplier")
+	if err != nil {
+		return nil, err
+	}
+	err = putState(stub, companyKey(supplierName, "Percentage"), []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
+	if err != nil {
+		return nil, err
+	}
 
+	err = emitEvent(stub, EVENT_COMPANY_ADDED, CompanyEvent{CompanyName: supplierName, Role: "Supplier", Status: COMPANY_ACTIVE, Percentage: &percentage, InitialBalance: initialBalance})
 	if err != nil {
 		return nil, err
 	}
+
+	fmt.Println("running addSupplier()")
+
 	return nil, nil
 }
 
@@ -353,64 +636,82 @@ func (t *SimpleChaincode) removeSupplier(stub shim.ChaincodeStubInterface, args
 	var supplierName string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	supplierName = args[0]
 
-	// Delete all the key/value pairs from the ledger
-	stub.DelState(supplierName + "_Percentage")
-	stub.DelState(supplierName + "_Balance")
-
-	fmt.Println("running removeSupplier()")
-
-	return nil, nil
-}
-
-// +------------------------------------------------------------------+
-// | resetBalance - invoke function to reset the balance of a company |
-// +------------------------------------------------------------------+
-func (t *SimpleChaincode) resetBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var companyName string
-	var balance float64
-	var err error
-	
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	// Refuse to remove a company that is still in use
+	err := checkCompanyRemovable(stub, supplierName, "Supplier")
+	if err != nil {
+		return nil, err
 	}
-	
-	companyName = args[0]
-	balance, err = strconv.ParseFloat(args[1], 64)
 
-	stub.PutState(companyName + "_Balance", []byte(strconv.FormatFloat(balance, 'f', -1, 64)))
-
-	fmt.Println("running resetBalance()")
+	// Delete all the key/value pairs from the ledger
+	err = delState(stub, "Companies"+SEPARATOR+supplierName, companyKey(supplierName, "Percentage"), companyKey(supplierName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
 
+	err = emitEvent(stub, EVENT_COMPANY_REMOVED, CompanyEvent{CompanyName: supplierName, Role: "Supplier"})
 	if err != nil {
 		return nil, err
 	}
+
+	fmt.Println("running removeSupplier()")
+
 	return nil, nil
 }
 
 // +--------------------------------------------------------------------------+
 // | updatePercentage - invoke function to update the percentage of a company |
 // +--------------------------------------------------------------------------+
+// Only active CSPs and suppliers have a percentage, VMCs earn what is left
 func (t *SimpleChaincode) updatePercentage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var companyName string
 	var percentage float64
 	var err error
 	
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2")
 	}
 	
 	companyName = args[0]
-	percentage, err = strconv.ParseFloat(args[1], 64)
+	err = validateId("company name", companyName)
+	if err != nil {
+		return nil, err
+	}
+	percentage, err = parseAmount("percentage", args[1])
+	if err != nil {
+		return nil, err
+	}
 
-	stub.PutState(companyName + "_Percentage", []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
+	company, found, err := getCompany(stub, companyName)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown company "+companyName, "companyName", companyName)
+	}
+	if company.Role != "CSP" && company.Role != "Supplier" {
+		return nil, newError(ERR_INVALID_STATE, "Company "+companyName+" is a "+company.Role+". Only CSPs and suppliers have a percentage")
+	}
+	if company.Status == COMPANY_DEACTIVATED {
+		return nil, newError(ERR_INVALID_STATE, "Company "+companyName+" is deactivated")
+	}
+	err = checkPercentage(stub, companyName, company.Role, percentage)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putState(stub, companyKey(companyName, "Percentage"), []byte(strconv.FormatFloat(percentage, 'f', -1, 64)))
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running updatePercentage()")
 
+	err = emitEvent(stub, EVENT_COMPANY_PERCENTAGE_UPDATED, CompanyEvent{CompanyName: companyName, Role: company.Role, Status: company.Status, Percentage: &percentage})
 	if err != nil {
 		return nil, err
 	}
@@ -419,123 +720,279 @@ func (t *SimpleChaincode) updatePercentage(stub shim.ChaincodeStubInterface, arg
 
 // +-------------------------------------------------------------------------------------------------------------+
 // | recordTransaction - invoke function to record the transaction and update the companies balances accordingly |
+// | Params - transactionId, amount, supplierName, CSPName, VMCName, deviceTime, product, optional machineId     |
 // +-------------------------------------------------------------------------------------------------------------+
+// The transaction is dated with the ledger timestamp. deviceTime is the optional
+// clock of the vending machine, it is normalized to RFC 3339 UTC or left empty.
+// With a machineId the CSP is the one of the eSIM bound to the machine, CSPName
+// can then be left empty and is rejected when it names another CSP. The
+// machineId is required once the VMC has machines bound to eSIMs.
 
 func (t *SimpleChaincode) recordTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var supplierName, CSPName, VMCName, transactionId, date, amount, product string
+	var supplierName, CSPName, VMCName, transactionId, date, deviceTime, amount, product, machineId, eSIMId string
 	var amountval float64
 	var CSPval, VMCval, Supplierval, Totalval, CSPPercentage, SupplierPercentage float64
 	var CSPAdd, VMCAdd, SupplierAdd float64
 	var err error
-	var json string
 	//var jsonResp string
 
 	fmt.Println("running recordTransaction()")
 
-	if len(args) != 7 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5. Transaction Id, Amount and names of the 3 companies")
+	if len(args) != 7 && len(args) != 8 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 7 or 8. Transaction Id, Amount, names of the 3 companies, device time, product and optional machine id")
 	}
 		
 	// 0. Get the amount and company names from the parameters
 	transactionId = args[0]
 	amount = args[1]
-	amountval, err = strconv.ParseFloat(amount, 64)
+	amountval, err = parseAmount("amount", amount)
+	if err != nil {
+		return nil, err
+	}
+	if amountval <= 0 {
+		return nil, newError(ERR_INVALID_ARGS, "Invalid amount "+amount+". Expecting a positive number")
+	}
 	supplierName = args[2]
 	CSPName = args[3]
 	VMCName = args[4]
-	date = args[5]
+	deviceTime = strings.TrimSpace(args[5])
 	product = args[6]
-	
-	// 1. Retrieve the current balances and percentages from the ledger
-	CSPvalbytes, err := stub.GetState(CSPName + "_Balance")
-	VMCvalbytes, err := stub.GetState(VMCName + "_Balance")
-	Suppliervalbytes, err := stub.GetState(supplierName + "_Balance")
-	Totalvalbytes, err := stub.GetState("Total_Balance")
+	if len(args) == 8 {
+		machineId = args[7]
+	}
 
-	CSPval, err = strconv.ParseFloat(string(CSPvalbytes),64)
-	VMCval, err = strconv.ParseFloat(string(VMCvalbytes),64)
-	Supplierval, err = strconv.ParseFloat(string(Suppliervalbytes),64)
-	Totalval, err = strconv.ParseFloat(string(Totalvalbytes),64)
+	// The CSP of a machine is the CSP of its eSIM, not the one claimed by the caller
+	if machineId == "" {
+		bound, boundErr := hasBoundMachines(stub, VMCName)
+		if boundErr != nil {
+			return nil, boundErr
+		}
+		if bound {
+			return nil, newError(ERR_INVALID_ARGS, "VMC "+VMCName+" has machines bound to eSIMs. Expecting the machine id of the sale", "VMCName", VMCName)
+		}
+	} else {
+		machineCSPName, machineESIMId, machineErr := machineCSP(stub, machineId, VMCName)
+		if machineErr != nil {
+			return nil, machineErr
+		}
+		if CSPName != "" && CSPName != machineCSPName {
+			return nil, newError(ERR_CONFLICT, "CSP "+CSPName+" does not match "+machineCSPName+", the CSP of the eSIM of machine "+machineId)
+		}
+		CSPName = machineCSPName
+		eSIMId = machineESIMId
+	}
 
-	CSPPercentagebytes, err := stub.GetState(CSPName + "_Percentage")
-	SupplierPercentagebytes, err := stub.GetState(supplierName + "_Percentage")
+	idErr := validateIds("transaction id", transactionId, "supplier name", supplierName, "CSP name", CSPName, "VMC name", VMCName, "product", product)
+	if idErr != nil {
+		return nil, idErr
+	}
 
-	CSPPercentage, err = strconv.ParseFloat(string(CSPPercentagebytes),64)
-	SupplierPercentage, err = strconv.ParseFloat(string(SupplierPercentagebytes),64)
-	
-	// 2. Calculate the amounts that needs to be added for each company
-	CSPAdd = amountval*CSPPercentage
-	SupplierAdd = amountval*SupplierPercentage
-	VMCAdd = (amountval - CSPAdd) - SupplierAdd
-	
-	// 3. Update all the balances from the new amount
-	Totalval = Totalval + amountval
-	CSPval = CSPval + CSPAdd
-	Supplierval = Supplierval + SupplierAdd
-	VMCval = VMCval + VMCAdd
-	
-	// 4. Write the update balances back to the ledger
-	stub.PutState(CSPName + "_Balance_" + transactionId, []byte(strconv.FormatFloat(CSPval, 'f', -1, 64)))
-	stub.PutState(VMCName + "_Balance_" + transactionId, []byte(strconv.FormatFloat(VMCval, 'f', -1, 64)))
-	stub.PutState(supplierName + "_Balance_" + transactionId, []byte(strconv.FormatFloat(Supplierval, 'f', -1, 64)))
-	
-	// 5. Write the update balances back to the ledger
-	stub.PutState(CSPName + "_Balance", []byte(strconv.FormatFloat(CSPval, 'f', -1, 64)))
-	stub.PutState(VMCName + "_Balance", []byte(strconv.FormatFloat(VMCval, 'f', -1, 64)))
-	stub.PutState(supplierName + "_Balance", []byte(strconv.FormatFloat(Supplierval, 'f', -1, 64)))
-	stub.PutState("Total_Balance", []byte(strconv.FormatFloat(Totalval, 'f', -1, 64)))
+	// A transaction id is recorded once, a replay would count the sale twice
+	existingBytes, err := stub.GetState("Transactions"+SEPARATOR+transactionId)
+	if err != nil {
+		return nil, ledgerError("get", "Transactions"+SEPARATOR+transactionId, err)
+	}
+	if len(existingBytes) > 0 {
+		return nil, newError(ERR_CONFLICT, "Transaction "+transactionId+" already recorded", "transactionId", transactionId)
+	}
 
-	// 5. Store all the new balances associated with the transactions
-	json = "{\"transactionId\":\"" + transactionId + "\",\"amount\":\"" + amount + "\",\"Date\":\"" + date + "\","
-	json += "\"ProductName\":\"" + product + "\",\"SupplierName\":\"" + supplierName + "\",\"CSPName\":\"" + CSPName + "\",\"VMCName\":\"" + VMCName + "\","
-	json += "\"balances\":[{\"companyName\":\"" + supplierName + "\",\"balance\":" + strconv.FormatFloat(Supplierval, 'f', -1, 64) + "},"
-	json += "{\"companyName\":\"" + CSPName + "\",\"balance\":" + strconv.FormatFloat(CSPval, 'f', -1, 64) + "},"
-	json += "{\"companyName\":\"" + VMCName + "\",\"balance\":" + strconv.FormatFloat(VMCval, 'f', -1, 64) + "}]}"
-	
-	fmt.Println("recordTransaction.json stored = " + json)
-	stub.PutState("Transactions" + SEPARATOR + transactionId, []byte(json))
-		
-	// 5. Return the new balances -- CANNOT!
-	//jsonResp = "{\"" + supplierName + "_Balance\":\"" + strconv.FormatFloat(Supplierval, 'f', -1, 64) + "\","
-	//jsonResp += "\"" + CSPName + "_Balance\":\"" + strconv.FormatFloat(CSPval, 'f', -1, 64) + "\","
-	//jsonResp += "\"" + VMCName + "_Balance\":\"" + strconv.FormatFloat(VMCval, 'f', -1, 64) + "\"}"
+	// Only registered and active companies can take part in new sales
+	companies := [][2]string{{supplierName, "Supplier"}, {CSPName, "CSP"}, {VMCName, "VMC"}}
+	for _, company := range companies {
+		if activeErr := checkCompanyActive(stub, company[0], company[1]); activeErr != nil {
+			return nil, activeErr
+		}
+	}
+
+	txTime, timeErr := transactionTime(stub)
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	date = formatTime(txTime)
+	if deviceTime != "" {
+		deviceDate, _, timeErr := parseDate(deviceTime)
+		if timeErr != nil {
+			return nil, wrapError("Invalid device time", timeErr)
+		}
+		deviceTime = formatTime(deviceDate)
+	}
 	
-	//fmt.Println("recordTransaction.jsonResp = " + jsonResp)
+	// 1. Retrieve the current balances and percentages from the ledger
+	// Every value is read and parsed before anything is written
+	CSPval, err = readBalance(stub, companyKey(CSPName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
+	VMCval, err = readBalance(stub, companyKey(VMCName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
+	Supplierval, err = readBalance(stub, companyKey(supplierName, "Balance"))
+	if err != nil {
+		return nil, err
+	}
+	Totalval, err = readBalance(stub, "Total_Balance")
+	if err != nil {
+		return nil, err
+	}
+
+	CSPPercentage, err = readPercentage(stub, CSPName)
+	if err != nil {
+		return nil, err
+	}
+	SupplierPercentage, err = readPercentage(stub, supplierName)
+	if err != nil {
+		return nil, err
+	}
+	for _, percentage := range []float64{CSPPercentage, SupplierPercentage} {
+		if percentage < 0 || percentage > 1 {
+			return nil, newError(ERR_INVALID_ARGS, "Invalid percentage "+strconv.FormatFloat(percentage, 'f', -1, 64)+". Expecting a number between 0 and 1")
+		}
+	}
+	err = checkPercentageSum(CSPName, CSPPercentage, supplierName, SupplierPercentage)
+	if err != nil {
+		return nil, err
+	}
+	
+	// 2. Calculate the amounts that needs to be added for each company
+	CSPAdd = amountval*CSPPercentage
+	SupplierAdd = amountval*SupplierPercentage
+	VMCAdd = (amountval - CSPAdd) - SupplierAdd
+	
+	// 3. Update all the balances from the new amount
+	Totalval = Totalval + amountval
+	CSPval = CSPval + CSPAdd
+	Supplierval = Supplierval + SupplierAdd
+	VMCval = VMCval + VMCAdd
+	
+	// 4. Write the balances after the transaction and the updated balances back to the ledger
+	balances := [][2]string{
+		{balanceSnapshotKey(CSPName, transactionId), strconv.FormatFloat(CSPval, 'f', -1, 64)},
+		{balanceSnapshotKey(VMCName, transactionId), strconv.FormatFloat(VMCval, 'f', -1, 64)},
+		{balanceSnapshotKey(supplierName, transactionId), strconv.FormatFloat(Supplierval, 'f', -1, 64)},
+		{companyKey(CSPName, "Balance"), strconv.FormatFloat(CSPval, 'f', -1, 64)},
+		{companyKey(VMCName, "Balance"), strconv.FormatFloat(VMCval, 'f', -1, 64)},
+		{companyKey(supplierName, "Balance"), strconv.FormatFloat(Supplierval, 'f', -1, 64)},
+		{"Total_Balance", strconv.FormatFloat(Totalval, 'f', -1, 64)},
+	}
+	for _, balance := range balances {
+		if err = putState(stub, balance[0], []byte(balance[1])); err != nil {
+			return nil, err
+		}
+	}
 
+	// 5. Store all the new balances associated with the transactions
+	transaction := Transaction{
+		TransactionId: transactionId,
+		Amount:        amount,
+		Date:          date,
+		ProductName:   product,
+		SupplierName:  supplierName,
+		CSPName:       CSPName,
+		VMCName:       VMCName,
+		DeviceTime:    deviceTime,
+		MachineId:     machineId,
+		ESIMId:        eSIMId,
+		Balances: []CompanyBalance{
+			{CompanyName: supplierName, Balance: Supplierval},
+			{CompanyName: CSPName, Balance: CSPval},
+			{CompanyName: VMCName, Balance: VMCval},
+		},
+		Shares: []CompanyShare{
+			{CompanyName: supplierName, Role: "Supplier", Amount: SupplierAdd},
+			{CompanyName: CSPName, Role: "CSP", Amount: CSPAdd},
+			{CompanyName: VMCName, Role: "VMC", Amount: VMCAdd},
+		},
+	}
+	transactionBytes, marshalErr := json.Marshal(transaction)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	
+	fmt.Println("recordTransaction.json stored = " + string(transactionBytes))
+	err = putState(stub, "Transactions"+SEPARATOR+transactionId, transactionBytes)
 	if err != nil {
-		fmt.Println("recordTransaction.error")
 		return nil, err
 	}
 
+	// 6. Post the sale to the accounts
+	saleLines := []JournalLine{{Account: CASH_ACCOUNT, Debit: amountval}}
+	for _, share := range transaction.Shares {
+		saleLines = append(saleLines, JournalLine{Account: companyAccount(share.CompanyName, "RevenueShare"), Credit: share.Amount})
+	}
+	if journalErr := postJournalEntry(stub, "Sale", transactionId, saleLines); journalErr != nil {
+		return nil, journalErr
+	}
+
+	// 7. Log the balance changes in the history of each company
+	for i, share := range transaction.Shares {
+		historyErr := recordBalanceChange(stub, share.CompanyName, share.Amount, transaction.Balances[i].Balance, "Sale", transactionId)
+		if historyErr != nil {
+			return nil, historyErr
+		}
+	}
+
+	// 8. Index the transaction by company, machine, product and date for searchTransactions
+	for _, indexKey := range transactionIndexKeys(transaction) {
+		if putErr := putState(stub, indexKey, []byte(transactionId)); putErr != nil {
+			return nil, putErr
+		}
+	}
+
+	// 9. Notify the listeners of the sale
+	if eventErr := emitEvent(stub, EVENT_SALE_RECORDED, transaction); eventErr != nil {
+		return nil, eventErr
+	}
+		
+	// 5. Return the new balances -- CANNOT!
+	//jsonResp = "{\"" + supplierName + "_Balance\":\"" + strconv.FormatFloat(Supplierval, 'f', -1, 64) + "\","
+	//jsonResp += "\"" + CSPName + "_Balance\":\"" + strconv.FormatFloat(CSPval, 'f', -1, 64) + "\","
+	//jsonResp += "\"" + VMCName + "_Balance\":\"" + strconv.FormatFloat(VMCval, 'f', -1, 64) + "\"}"
+	
+	//fmt.Println("recordTransaction.jsonResp = " + jsonResp)
+
 	return nil, nil
 	//return []byte(jsonResp), nil
 }
 
-// +---------------------------------------------+
-// | addESIM - invoke function to add a new eSIM |
-// | Params - eSIMId, Status, Manufacturer       |
-// +---------------------------------------------+
+// +-----------------------------------------------------+
+// | addESIM - invoke function to add a new eSIM         |
+// | Params - eSIMId, Status, Manufacturer, optional EID |
+// +-----------------------------------------------------+
+// The eSIM id is the ICCID of the profile. A new eSIM is either Provisioned
+// or directly Available.
 func (t *SimpleChaincode) addESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var manufacturer, eSIMId, status string
+	var manufacturer, eSIMId, status, eid string
 	var err error
 	
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 3")
+	if len(args) != 3 && len(args) != 4 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 3 or 4. ICCID, status, manufacturer and optional EID")
 	}
 	
 	eSIMId = args[0]
 	status = args[1]
 	manufacturer = args[2]
+	if len(args) == 4 {
+		eid = args[3]
+	}
 
-	// Create all the key/value pairs to the ledger
-	stub.PutState(eSIMId + "_Status", []byte(status))
-	stub.PutState(eSIMId + "_Manufacturer", []byte(manufacturer))
-
-	fmt.Println("running addESIM()")
+	err = validateNewESIM(manufacturer, status)
+	if err != nil {
+		return nil, err
+	}
+	err = checkESIMIdentifiers(stub, BatchItem{ICCID: eSIMId, EID: eid}, map[string]int{})
+	if err != nil {
+		return nil, err
+	}
 
+	// Create all the key/value pairs to the ledger
+	err = createESIM(stub, eSIMId, status, manufacturer, eid, "")
 	if err != nil {
 		return nil, err
 	}
+
+	fmt.Println("running addESIM()")
+
 	return nil, nil
 }
 
@@ -543,12 +1000,13 @@ func (t *SimpleChaincode) addESIM(stub shim.ChaincodeStubInterface, args []strin
 // | activateESIM - invoke function to activate an eSIM    |
 // | Params - eSIMId, CSPName, EndUserId, IoTId, IoTSecret |
 // +-------------------------------------------------------+
+// Only an Available eSIM can be activated
 func (t *SimpleChaincode) activateESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var eSIMId, CSPName, endUserId, IoTId, IoTSecret string
 	var err error
 	
 	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 5")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 5")
 	}
 	
 	eSIMId = args[0]
@@ -557,18 +1015,50 @@ func (t *SimpleChaincode) activateESIM(stub shim.ChaincodeStubInterface, args []
 	IoTId = args[3]
 	IoTSecret = args[4]
 
-	// Create all the key/value pairs to the ledger
-	stub.PutState(eSIMId + "_Status", []byte("Active"))
-	stub.PutState(eSIMId + "_CSP", []byte(CSPName))
-	stub.PutState(eSIMId + "_EndUser", []byte(endUserId))
-	stub.PutState(eSIMId + "_IoTId", []byte(IoTId))
-	stub.PutState(eSIMId + "_IoTSecret", []byte(IoTSecret))
+	err = validateIds("eSIM id", eSIMId, "CSP name", CSPName, "end user id", endUserId)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("running activateESIM()")
+	status, err := getESIMStatus(stub, eSIMId)
+	if err != nil {
+		return nil, err
+	}
+	if status != ESIM_AVAILABLE {
+		if status == "" {
+			return nil, newError(ERR_NOT_FOUND, "Unknown eSIM "+eSIMId, "eSIMId", eSIMId)
+		}
+		return nil, newError(ERR_INVALID_STATE, "Cannot activate eSIM "+eSIMId+" in state "+status+". Expecting "+ESIM_AVAILABLE)
+	}
+	if err = checkCompanyActive(stub, CSPName, "CSP"); err != nil {
+		return nil, err
+	}
 
+	// Create all the key/value pairs to the ledger
+	// The ESIMByCSP and ESIMByEndUser keys index the activated eSIMs of the CSP and of the end user
+	_, err = transitionESIM(stub, eSIMId, ESIM_ACTIVE)
 	if err != nil {
 		return nil, err
 	}
+	attributes := [][2]string{
+		{eSIMKey(eSIMId, "CSP"), CSPName},
+		{"ESIMByCSP" + SEPARATOR + CSPName + SEPARATOR + eSIMId, eSIMId},
+		{eSIMKey(eSIMId, "EndUser"), endUserId},
+		{"ESIMByEndUser" + SEPARATOR + endUserId + SEPARATOR + eSIMId, eSIMId},
+		{eSIMKey(eSIMId, "IoTId"), IoTId},
+	}
+	for _, attribute := range attributes {
+		if err = putState(stub, attribute[0], []byte(attribute[1])); err != nil {
+			return nil, err
+		}
+	}
+	err = storeIoTSecret(stub, eSIMId, IoTSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("running activateESIM()")
+
 	return nil, nil
 }
 
@@ -576,21 +1066,49 @@ func (t *SimpleChaincode) activateESIM(stub shim.ChaincodeStubInterface, args []
 // | deactivateESIM - invoke function to de-activate an eSIM |
 // | Params - eSIMId                                         |
 // +---------------------------------------------------------+
+// An Active or Suspended eSIM loses its CSP, end user and IoT credentials
 func (t *SimpleChaincode) deactivateESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var eSIMId string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	eSIMId = args[0]
 
+	CSPNameBytes, err := stub.GetState(eSIMKey(eSIMId, "CSP"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(eSIMId, "CSP"), err)
+	}
+	endUserIdBytes, err := stub.GetState(eSIMKey(eSIMId, "EndUser"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(eSIMId, "EndUser"), err)
+	}
+	machineIdBytes, err := stub.GetState(eSIMKey(eSIMId, "Machine"))
+	if err != nil {
+		return nil, ledgerError("get", eSIMKey(eSIMId, "Machine"), err)
+	}
+
+	_, err = transitionESIM(stub, eSIMId, ESIM_DEACTIVATED)
+	if err != nil {
+		return nil, err
+	}
+
 	// Delete all the key/value pairs to the ledger
-	stub.PutState(eSIMId + "_Status", []byte("Inactive"))
-	stub.DelState(eSIMId + "_CSP")
-	stub.DelState(eSIMId + "_EndUser")
-	stub.DelState(eSIMId + "_IoTId")
-	stub.DelState(eSIMId + "_IoTSecret")
+	err = delState(stub, "ESIMByCSP"+SEPARATOR+string(CSPNameBytes)+SEPARATOR+eSIMId, "ESIMByEndUser"+SEPARATOR+string(endUserIdBytes)+SEPARATOR+eSIMId,
+		eSIMKey(eSIMId, "CSP"), eSIMKey(eSIMId, "EndUser"), eSIMKey(eSIMId, "IoTId"), eSIMKey(eSIMId, "IoTSecretSalt"), eSIMKey(eSIMId, "IoTSecretHash"),
+		eSIMKey(eSIMId, "Suspension"), eSIMKey(eSIMId, "PendingTransfer"))
+	if err != nil {
+		return nil, err
+	}
+
+	// A deactivated eSIM no longer serves its machine
+	if len(machineIdBytes) > 0 {
+		err = unbindMachine(stub, eSIMId, string(machineIdBytes))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	fmt.Println("running deactivateESIM()")
 
@@ -601,18 +1119,21 @@ func (t *SimpleChaincode) deactivateESIM(stub shim.ChaincodeStubInterface, args
 // | removeESIM - invoke function to remove an eSIM |
 // | Params - eSIMId                                |
 // +------------------------------------------------+
+// The eSIM is Retired, an active eSIM must be deactivated first. Its status,
+// manufacturer and history are kept so that the id cannot be reused.
 func (t *SimpleChaincode) removeESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	var eSIMId string
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
 	
 	eSIMId = args[0]
 
-	// Delete all the key/value pairs to the ledger
-	stub.DelState(eSIMId + "_Status")
-	stub.DelState(eSIMId + "_Manufacturer")
+	_, err := transitionESIM(stub, eSIMId, ESIM_RETIRED)
+	if err != nil {
+		return nil, err
+	}
 
 	fmt.Println("running removeESIM()")
 
@@ -625,7 +1146,19 @@ func (t *SimpleChaincode) removeESIM(stub shim.ChaincodeStubInterface, args []st
 // +--------------------------------------+
 // | Query is our entry point for queries |
 // +--------------------------------------+
+// Every error reaches the client as a serialized ChaincodeError
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+	result, err := t.query(stub, function, args)
+	if err != nil {
+		return nil, toChaincodeError(err)
+	}
+	return result, nil
+}
+
+// +--------------------------------------+
+// | query - dispatch a query             |
+// +--------------------------------------+
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	fmt.Println("query is running " + function)
 
 	// Handle different functions
@@ -635,12 +1168,46 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 		return t.getAllTransactions(stub, args)
 	} else if function == "getTransaction" {
 		return t.getTransaction(stub, args)
+	} else if function == "searchTransactions" {
+		return t.searchTransactions(stub, args)
 	} else if function == "getBalance" {
 		return t.getBalance(stub, args)
 	} else if function == "getBalanceWithTransaction" {
 		return t.getBalanceWithTransaction(stub, args)
+	} else if function == "getBalanceHistory" {
+		return t.getBalanceHistory(stub, args)
+	} else if function == "getBalanceAdjustments" {
+		return t.getBalanceAdjustments(stub, args)
+	} else if function == "reconcile" {
+		return t.reconcile(stub, args)
+	} else if function == "getTrialBalance" {
+		return t.getTrialBalance(stub, args)
+	} else if function == "getJournal" {
+		return t.getJournal(stub, args)
+	} else if function == "getSettledBalance" {
+		return t.getSettledBalance(stub, args)
+	} else if function == "getSettlementStatements" {
+		return t.getSettlementStatements(stub, args)
 	} else if function == "getESIM" {
 		return t.getESIM(stub, args)
+	} else if function == "searchESIMs" {
+		return t.searchESIMs(stub, args)
+	} else if function == "getESIMFleetSummary" {
+		return t.getESIMFleetSummary(stub, args)
+	} else if function == "getESIMTransfers" {
+		return t.getESIMTransfers(stub, args)
+	} else if function == "getESIMBatch" {
+		return t.getESIMBatch(stub, args)
+	} else if function == "getDataPlan" {
+		return t.getDataPlan(stub, args)
+	} else if function == "getESIMUsage" {
+		return t.getESIMUsage(stub, args)
+	} else if function == "getUsageByPeriod" {
+		return t.getUsageByPeriod(stub, args)
+	} else if function == "getESIMHistory" {
+		return t.getESIMHistory(stub, args)
+	} else if function == "verifyIoTSecret" {
+		return t.verifyIoTSecret(stub, args)
 	} else if function == "readProduct" {
 		return t.readProduct(stub, args)
 	} else if function == "readAllProducts" {
@@ -656,69 +1223,61 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	}
 	fmt.Println("query did not find func: " + function)
 
-	return nil, errors.New("Received unknown function query: " + function)
+	return nil, newError(ERR_INVALID_ARGS, "Received unknown function query: "+function)
 }
 
 // +---------------------------------------------------------------------------------+
 // | getAllTransactions - query function to all transactions and associated balances |
+// | Params - optional pageSize=, bookmark=                                          |
 // +---------------------------------------------------------------------------------+
 func (t *SimpleChaincode) getAllTransactions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var jsonResp, transactionDetails string
+	var filters map[string]string
+	var paging Paging
+	var page Page
 	var err error
 
+	filters, err = parseFilters(args, "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+
 	var prefix = "Transactions" + SEPARATOR
 
-	iter, err := stub.RangeQueryState(prefix, prefix + "}")
-	
-	jsonResp = "["
-	
-	var i int
-	i = 0
-	
-	for iter.HasNext() {
-		ledgerKey, transactionDetailsBytes, err := iter.Next()
-		
+	page, err = queryPage(stub, prefix, paging, func(ledgerKey string, transactionDetailsBytes []byte) (json.RawMessage, error) {
 		fmt.Println("getAllTransactions found transaction: " + ledgerKey)
-		if err != nil {
-			err = fmt.Errorf("getAllTransactions iter.Next() failed: %s", err)
-			//log.Error(err)
-			return nil, err
-		}
-		
-		transactionDetails = string(transactionDetailsBytes)
-		if(i>0) {
-			jsonResp += ","
-		}
-		jsonResp += transactionDetails
-		i ++
-	}
-
-	jsonResp += "]"
-	
+		return json.RawMessage(transactionDetailsBytes), nil
+	})
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get all transactions infos\"}"
-		return nil, errors.New(jsonResp)
+		return nil, wrapError("getAllTransactions failed", err)
 	}
 
-	return []byte(jsonResp), nil
+	return json.Marshal(page)
 }
 
 // +------------------------------------------------------------------------------------+
 // | getTransaction - query function to read the balances associated with a transaction |
 // +------------------------------------------------------------------------------------+
+// Fails with NOT_FOUND when the transaction was never recorded
 func (t *SimpleChaincode) getTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp, transactionId string
+	var key, transactionId string
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting transaction id")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting transaction id")
 	}
 	
 	transactionId = args[0]
-	valAsbytes, err := stub.GetState("Transactions" + SEPARATOR + transactionId)
+	key = "Transactions" + SEPARATOR + transactionId
+	valAsbytes, err := stub.GetState(key)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ledgerError("get", key, err)
+	}
+	if len(valAsbytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown transaction "+transactionId, "transactionId", transactionId)
 	}
 
 	return valAsbytes, nil
@@ -727,20 +1286,23 @@ func (t *SimpleChaincode) getTransaction(stub shim.ChaincodeStubInterface, args
 // +----------------------------------------------------------------+
 // | getBalance - query function to read the balance of the company |
 // +----------------------------------------------------------------+
+// Fails with NOT_FOUND for unknown companies, every company has a balance
 func (t *SimpleChaincode) getBalance(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp, companyName string
+	var key, companyName string
 	var err error
 
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the company to get the balance")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting name of the company to get the balance")
 	}
 	
 	companyName = args[0]
-	key = companyName + "_Balance"
+	key = companyKey(companyName, "Balance")
 	valAsbytes, err := stub.GetState(key)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ledgerError("get", key, err)
+	}
+	if len(valAsbytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown company "+companyName, "companyName", companyName)
 	}
 
 	return valAsbytes, nil
@@ -749,21 +1311,24 @@ func (t *SimpleChaincode) getBalance(stub shim.ChaincodeStubInterface, args []st
 // +----------------------------------------------------------------------------------------------------------------+
 // | getBalanceWithTransaction - query function to read the balance of the company associated with a transaction Id |
 // +----------------------------------------------------------------------------------------------------------------+
+// Fails with NOT_FOUND when the company took no part in the transaction
 func (t *SimpleChaincode) getBalanceWithTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp, companyName, transactionId string
+	var key, companyName, transactionId string
 	var err error
 
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting transaction Id and name of the company to get the balance")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting transaction Id and name of the company to get the balance")
 	}
 	
 	transactionId = args[0]
 	companyName = args[1]
-	key = companyName + "_Balance_" + transactionId
+	key = balanceSnapshotKey(companyName, transactionId)
 	valAsbytes, err := stub.GetState(key)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, ledgerError("get", key, err)
+	}
+	if len(valAsbytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "No balance of company "+companyName+" for transaction "+transactionId, "companyName", companyName, "transactionId", transactionId)
 	}
 
 	return valAsbytes, nil
@@ -771,143 +1336,236 @@ func (t *SimpleChaincode) getBalanceWithTransaction(stub shim.ChaincodeStubInter
 
 // +------------------------------------------------------------+
 // | getESIM - query function to read the parameters of an eSIM |
+// | Params - ICCID or EID                                      |
 // +------------------------------------------------------------+
+// Fails with NOT_FOUND when no eSIM has this ICCID or EID
 func (t *SimpleChaincode) getESIM(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var eSIMId, status, manufacturer, CSPName, endUserId, IoTId, IoTSecret string
-	var jsonResp string
-	var err error
-
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1")
 	}
-	
-	eSIMId = args[0]
-	
-	manufacturerBytes, err := stub.GetState(eSIMId + "_Manufacturer")
-	statusBytes, err := stub.GetState(eSIMId + "_Status")
-	CSPNameBytes, err := stub.GetState(eSIMId + "_CSP")
-	endUserIdBytes, err := stub.GetState(eSIMId + "_EndUser")
-	IoTIdBytes, err := stub.GetState(eSIMId + "_IoTId")
-	IoTSecretBytes, err := stub.GetState(eSIMId + "_IoTSecret")
-
-	manufacturer = string(manufacturerBytes)
-	status = string(statusBytes)
-	CSPName = string(CSPNameBytes)
-	endUserId = string(endUserIdBytes)
-	IoTId = string(IoTIdBytes)
-	IoTSecret = string(IoTSecretBytes)
-	
-	jsonResp = "{\"eSIMId\":\"" + eSIMId + "\",\"status\":\"" + status + "\",\"CSP\":\"" + CSPName + "\",\"manufacturer\":\"" + manufacturer
-	jsonResp += "\",\"EndUser\":\"" + endUserId + "\",\"IoTId\":\"" + IoTId + "\",\"IoTSecret\":\"" + IoTSecret + "\"}";
 
+	eSIMId, err := resolveESIMId(stub, args[0])
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get products infos\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
+	}
+	eSIM, found, err := getESIMRecord(stub, eSIMId)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, newError(ERR_NOT_FOUND, "Unknown eSIM "+args[0], "eSIMId", args[0])
 	}
 
-	return []byte(jsonResp), nil
+	return json.Marshal(eSIM)
 }
 
 // +---------------------------------------------+
 // | readProduct - read a product in the catalog |
+// | Params - productId                          |
 // +---------------------------------------------+
+// Fails with NOT_FOUND when the product is not in the catalog
 func (t *SimpleChaincode) readProduct(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var productId, productName, productImg, productPrice, productQRCode, entity string
-	var jsonResp string
+	var productId string
+	var product Product
 	var err error
+
+	if len(args) != 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1. Product id")
+	}
 	
 	productId = args[0]
+
+	// The Products index lists the products of the catalog
+	key := "Products" + SEPARATOR + productId
+	indexBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ledgerError("get", key, err)
+	}
+	if len(indexBytes) == 0 {
+		return nil, newError(ERR_NOT_FOUND, "Unknown product "+productId, "productId", productId)
+	}
 	
 	// Read attributes from the ledger
-	productEntityBytes, err := stub.GetState(productId + "_Entity")
-	productNameBytes, err := stub.GetState(productId + "_Name")
-	productImgBytes, err := stub.GetState(productId + "_Image")
-	productPriceBytes, err := stub.GetState(productId + "_Price")
-	productQRCodeBytes, err := stub.GetState(productId + "_QRCode")
-	
-	entity = string(productEntityBytes)
-	productName = string(productNameBytes)
-	productImg = string(productImgBytes)
-	productPrice = string(productPriceBytes)
-	productQRCode = string(productQRCodeBytes)
-		
-	jsonResp = "["
-	jsonResp += "{\"productId\":\"" + productId + "\",\"relatedEntity\":\"" + entity + "\",\"productName\":\"" + productName + "\",\"productImg\":\"" + productImg
-	jsonResp += "\",\"productPrice\":\"" + productPrice + "\",\"productQRCode\":\"" + productQRCode + "\"}";
-	jsonResp += "]"
-	
+	product, err = getProduct(stub, productId)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get product info\"}"
-		return nil, errors.New(jsonResp)
+		return nil, wrapError("Failed to get product "+productId, err)
 	}
 
-	return []byte(jsonResp), nil
+	productBytes, err := json.Marshal([]Product{product})
+	if err != nil {
+		return nil, err
+	}
+
+	return productBytes, nil
 }
 
 // +----------------------------------------------------------------------+
 // | readAllProducts - query function to read all products in the catalog |
+// | Params - optional filters: category=, tag=, entity=,                 |
+// |          minPrice=, maxPrice=, pageSize=, bookmark=                  |
 // +----------------------------------------------------------------------+
 func (t *SimpleChaincode) readAllProducts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var productId, productName, productImg, productPrice, productQRCode, entity string
-	var jsonResp string
+	var filters map[string]string
+	var paging Paging
+	var page Page
 	var err error
-	
-	// RangeQueryState function can be invoked by a chaincode to query of a range
-	// of keys in the state. Assuming the startKey and endKey are in lexical order,
-	// an iterator will be returned that can be used to iterate over all keys
-	// between the startKey and endKey, inclusive. The order in which keys are
-	// returned by the iterator is random.
 
-	iter, err := stub.RangeQueryState("Product_", "Product_}")
-	
-	jsonResp = "["
-	
-	var i int
-	i = 0
-	
-	for iter.HasNext() {
-		ledgerKey, productIdBytes, err := iter.Next()
-		productId = string(productIdBytes)
+	filters, err = parseFilters(args, "category", "tag", "entity", "minPrice", "maxPrice", "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
+	// The price range is checked before the scan, even when no product has a price
+	prices, err := parsePriceRange(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err = queryPage(stub, "Products"+SEPARATOR, paging, func(ledgerKey string, productIdBytes []byte) (json.RawMessage, error) {
+		productId := string(productIdBytes)
 		fmt.Println("readAllProducts found product: " + productId + "\n and ledge key: " + ledgerKey)
+
+		// Read attributes from the ledger
+		product, err := getProduct(stub, productId)
 		if err != nil {
-			err = fmt.Errorf("readAllProducts iter.Next() failed: %s", err)
-			//log.Error(err)
 			return nil, err
 		}
-		// log.Debug("readAllProducts found product: " + productId + "\n")
-		//err = json.Unmarshal(assetBytes, &state)
-		
-		// Read attributes from the ledger
-		productEntityBytes, err := stub.GetState(productId + "_Entity")
-		productNameBytes, err := stub.GetState(productId + "_Name")
-		productImgBytes, err := stub.GetState(productId + "_Image")
-		productPriceBytes, err := stub.GetState(productId + "_Price")
-		productQRCodeBytes, err := stub.GetState(productId + "_QRCode")
-		
-		entity = string(productEntityBytes)
-		productName = string(productNameBytes)
-		productImg = string(productImgBytes)
-		productPrice = string(productPriceBytes)
-		productQRCode = string(productQRCodeBytes)
-		
-		if(i>0) {
-			jsonResp += ","
+
+		if !product.matches(filters, prices) {
+			return nil, nil
 		}
-		
-		jsonResp += "{\"productId\":\"" + productId + "\",\"relatedEntity\":\"" + entity + "\",\"productName\":\"" + productName + "\",\"productImg\":\"" + productImg
-		jsonResp += "\",\"productPrice\":\"" + productPrice + "\",\"productQRCode\":\"" + productQRCode + "\"}";
+		return json.Marshal(product)
+	})
+	if err != nil {
+		return nil, wrapError("readAllProducts failed", err)
+	}
+
+	return json.Marshal(page)
+}
 
-		i ++
+// +-------------------------------------------------------+
+// | getProduct - read all the attributes of a product     |
+// +-------------------------------------------------------+
+func getProduct(stub shim.ChaincodeStubInterface, productId string) (Product, error) {
+	var product Product
+	var err error
+
+	product.ProductId = productId
+
+	fields := []struct {
+		attribute string
+		value     *string
+	}{
+		{"Entity", &product.Entity},
+		{"Name", &product.ProductName},
+		{"Image", &product.ProductImg},
+		{"Price", &product.ProductPrice},
+		{"QRCode", &product.ProductQRCode},
+		{"Category", &product.Category},
+	}
+	for _, field := range fields {
+		valueBytes, err := stub.GetState(productKey(productId, field.attribute))
+		if err != nil {
+			return product, ledgerError("get", productKey(productId, field.attribute), err)
+		}
+		*field.value = string(valueBytes)
 	}
 
-	jsonResp += "]"
-	
+	tagsBytes, err := stub.GetState(productKey(productId, "Tags"))
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get eSIM infos\"}"
-		return nil, errors.New(jsonResp)
+		return product, ledgerError("get", productKey(productId, "Tags"), err)
 	}
+	product.Tags = splitList(string(tagsBytes))
 
-	return []byte(jsonResp), nil
+	allergensBytes, err := stub.GetState(productKey(productId, "Allergens"))
+	if err != nil {
+		return product, ledgerError("get", productKey(productId, "Allergens"), err)
+	}
+	product.Allergens = splitList(string(allergensBytes))
+
+	nutritionBytes, err := stub.GetState(productKey(productId, "Nutrition"))
+	if err != nil {
+		return product, ledgerError("get", productKey(productId, "Nutrition"), err)
+	}
+	product.Nutrition = map[string]string{}
+	if len(nutritionBytes) > 0 {
+		if err = json.Unmarshal(nutritionBytes, &product.Nutrition); err != nil {
+			return product, errorf(ERR_CORRUPTED_STATE, "Corrupted nutrition attributes for %s: %s", productId, err)
+		}
+	}
+
+	return product, nil
+}
+
+// PriceRange is the minPrice= and maxPrice= filters of readAllProducts
+type PriceRange struct {
+	Min    float64
+	Max    float64
+	HasMin bool
+	HasMax bool
+}
+
+// parsePriceRange reads the minPrice= and maxPrice= filters
+func parsePriceRange(filters map[string]string) (PriceRange, error) {
+	var prices PriceRange
+	var err error
+
+	if minPrice, ok := filters["minPrice"]; ok {
+		prices.Min, err = strconv.ParseFloat(minPrice, 64)
+		if err != nil {
+			return prices, newError(ERR_INVALID_ARGS, "Invalid minPrice filter: "+minPrice)
+		}
+		prices.HasMin = true
+	}
+	if maxPrice, ok := filters["maxPrice"]; ok {
+		prices.Max, err = strconv.ParseFloat(maxPrice, 64)
+		if err != nil {
+			return prices, newError(ERR_INVALID_ARGS, "Invalid maxPrice filter: "+maxPrice)
+		}
+		prices.HasMax = true
+	}
+	return prices, nil
+}
+
+// matches checks the product against the catalog filters of readAllProducts
+func (p Product) matches(filters map[string]string, prices PriceRange) bool {
+	if category, ok := filters["category"]; ok && !strings.EqualFold(p.Category, category) {
+		return false
+	}
+	if entity, ok := filters["entity"]; ok && p.Entity != entity {
+		return false
+	}
+	if tag, ok := filters["tag"]; ok {
+		found := false
+		for _, t := range p.Tags {
+			if strings.EqualFold(t, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if !prices.HasMin && !prices.HasMax {
+		return true
+	}
+	// Products without a numeric price never match a price range
+	price, err := strconv.ParseFloat(p.ProductPrice, 64)
+	if err != nil {
+		return false
+	}
+	if prices.HasMin && price < prices.Min {
+		return false
+	}
+	if prices.HasMax && price > prices.Max {
+		return false
+	}
+	return true
 }
 
 // +---------------------------------------------------------------------------------------+
@@ -919,211 +1577,171 @@ func (t *SimpleChaincode) getInventoryByEntityAndProduct(stub shim.ChaincodeStub
 	var err error
 
 	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2")
 	}
 	
 	entityId = args[0]
 	productId = args[1]
 	
-	quantityBytes, err := stub.GetState("InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId)
+	key := "InventoryByProduct" + SEPARATOR + entityId + SEPARATOR + productId
+	quantityBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, ledgerError("get", key, err)
+	}
 
 	quantity = string(quantityBytes)
 	
 	jsonResp = "{\"quantity\":\"" + quantity + "\"}";
 
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get product infos\"}"
-		return nil, errors.New(jsonResp)
-	}
-
 	return []byte(jsonResp), nil
 }
 
 // +------------------------------------------------------------------------------------------------+
 // | getInventoryByEntityAndLocation - retrieve the product and quantity for an entity and location |
+// | Params - entityId, locationId, optional pageSize=, bookmark=                                   |
 // +------------------------------------------------------------------------------------------------+
 func (t *SimpleChaincode) getInventoryByEntityAndLocation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var entityId, locationId, productId, quantity, keyPrefix string
-	var jsonResp string
-	var q int
+	var entityId, locationId, keyPrefix string
+	var filters map[string]string
+	var paging Paging
+	var page Page
 	var err error
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2")
+	if len(args) < 2 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 2, followed by optional pageSize= and bookmark=")
 	}
 	
 	entityId = args[0]
 	locationId = args[1]
+
+	filters, err = parseFilters(args[2:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
 	
 	keyPrefix = "InventoryByLocation" + SEPARATOR + entityId + SEPARATOR + locationId + SEPARATOR
 	l := len(keyPrefix)
-	iter, err := stub.RangeQueryState(keyPrefix, keyPrefix + "{")
-	
-	jsonResp = "["
-	
-	var i int
-	i = 0
-	
-	for iter.HasNext() {
-		ledgerKey, quantityBytes, err := iter.Next()
-		if err != nil {
-			err = fmt.Errorf("iter.Next() failed: %s", err)
-			return nil, err
-		}
-		productId = ledgerKey[l:len(ledgerKey)]
-		quantity = string(quantityBytes)
-		fmt.Println("getInventoryByEntityAndLocation found product: " + productId + "\n and quantity: " + quantity)
-		
-		q, err = strconv.Atoi(quantity)
-		if q > 0 {
-			if i > 0 {
-				jsonResp += ","
-			}
-
-			// Read attributes from the ledger
-			productEntityBytes, err2 := stub.GetState(productId + "_Entity")
-			productNameBytes, err2 := stub.GetState(productId + "_Name")
-			productImgBytes, err2 := stub.GetState(productId + "_Image")
-			productPriceBytes, err2 := stub.GetState(productId + "_Price")
-			productQRCodeBytes, err2 := stub.GetState(productId + "_QRCode")
-	
-			entity := string(productEntityBytes)
-			productName := string(productNameBytes)
-			productImg := string(productImgBytes)
-			productPrice := string(productPriceBytes)
-			productQRCode := string(productQRCodeBytes)
-		
-			jsonResp += "{\"productId\":\"" + productId + "\",\"quantity\":\"" + quantity + "\",\"relatedEntity\":\"" + entity + "\",\"productName\":\"" + productName + "\",\"productImg\":\"" + productImg
-			jsonResp += "\",\"productPrice\":\"" + productPrice + "\",\"productQRCode\":\"" + productQRCode + "\"}";
-			i ++
-
-			if err2 != nil {
-				jsonResp = "{\"Error\":\"Failed to get infos\"}"
-			}
-		}
-	}
-
-	jsonResp += "]"
 
+	page, err = queryPage(stub, keyPrefix, paging, func(ledgerKey string, quantityBytes []byte) (json.RawMessage, error) {
+		productId := ledgerKey[l:len(ledgerKey)]
+		fmt.Println("getInventoryByEntityAndLocation found product: " + productId + "\n and quantity: " + string(quantityBytes))
+		return inventoryRecord(stub, "", "", productId, quantityBytes)
+	})
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get infos\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 
-	return []byte(jsonResp), nil
+	return json.Marshal(page)
 }
 
 // +----------------------------------------------------------------------------------+
 // | getAllInventoryByEntity - retrieve all products and quantities for each location |
+// | Params - entityId, optional pageSize=, bookmark=                                 |
 // +----------------------------------------------------------------------------------+
 func (t *SimpleChaincode) getAllInventoryByEntity(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var entityId, locationId, productId, quantity, keyPrefix string
-	var jsonResp string
-	var q int
+	var entityId, keyPrefix string
+	var filters map[string]string
+	var paging Paging
+	var page Page
 	var err error
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
+	if len(args) < 1 {
+		return nil, newError(ERR_INVALID_ARGS, "Incorrect number of arguments. Expecting 1, followed by optional pageSize= and bookmark=")
 	}
 	
 	entityId = args[0]
+
+	filters, err = parseFilters(args[1:], "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
 	
-	// Format Inventory_EntityId_LocationId_ProductId
+	// Format InventoryByLocation##EntityId##LocationId##ProductId
 	keyPrefix = "InventoryByLocation" + SEPARATOR + entityId + SEPARATOR
 	l := len(keyPrefix)
-	iter, err := stub.RangeQueryState(keyPrefix, keyPrefix + "{")
-	
-	jsonResp = "["
-	
-	var i int
-	i = 0
-	
-	for iter.HasNext() {
-		ledgerKey, quantityBytes, err := iter.Next()
-		
-		fmt.Println("LedgerKey = " + ledgerKey);
-		if err != nil {
-			err = fmt.Errorf("iter.Next() failed: %s", err)
-			return nil, err
-		}
-		
-		// Retrieve locationId from the ledger key
-		locationAndProduct := ledgerKey[l:len(ledgerKey)]
-		fmt.Println("locationAndProduct = " + locationAndProduct);
-		j := strings.Index(locationAndProduct, SEPARATOR)
-		locationId = locationAndProduct[0:j]
-		fmt.Println("locationId = " + locationId);
-		productId = locationAndProduct[j+len(SEPARATOR):len(locationAndProduct)]
-		fmt.Println("productId = " + productId);
-		quantity = string(quantityBytes)
-		fmt.Println("quantity = " + quantity);
-		
-		fmt.Println("getAllInventoryByEntity found product: " + productId + " in location " + locationId + " with quantity: " + quantity)
 
-		q, err = strconv.Atoi(quantity)
-		if q > 0 {
-			if i > 0 {
-				jsonResp += ","
-			}
-
-			// Read attributes from the ledger
-			productEntityBytes, err2 := stub.GetState(productId + "_Entity")
-			productNameBytes, err2 := stub.GetState(productId + "_Name")
-			productImgBytes, err2 := stub.GetState(productId + "_Image")
-			productPriceBytes, err2 := stub.GetState(productId + "_Price")
-			productQRCodeBytes, err2 := stub.GetState(productId + "_QRCode")
-	
-			entity := string(productEntityBytes)
-			productName := string(productNameBytes)
-			productImg := string(productImgBytes)
-			productPrice := string(productPriceBytes)
-			productQRCode := string(productQRCodeBytes)
-		
-			jsonResp += "{\"productId\":\"" + productId + "\",\"locationId\":\"" + locationId + "\",\"quantity\":\"" + quantity + "\",\"relatedEntity\":\"" + entity + "\",\"productName\":\"" + productName + "\",\"productImg\":\"" + productImg
-			jsonResp += "\",\"productPrice\":\"" + productPrice + "\",\"productQRCode\":\"" + productQRCode + "\"}";
-			i ++
-
-			if err2 != nil {
-				jsonResp = "{\"Error\":\"Failed to get infos\"}"
-			}
+	page, err = queryPage(stub, keyPrefix, paging, func(ledgerKey string, quantityBytes []byte) (json.RawMessage, error) {
+		// Retrieve locationId and productId from the ledger key
+		locationAndProduct := strings.SplitN(ledgerKey[l:len(ledgerKey)], SEPARATOR, 2)
+		if len(locationAndProduct) != 2 {
+			return nil, newError(ERR_CORRUPTED_STATE, "Invalid inventory key "+ledgerKey)
 		}
-	}
-
-	jsonResp += "]"
-
+		fmt.Println("getAllInventoryByEntity found product: " + locationAndProduct[1] + " in location " + locationAndProduct[0] + " with quantity: " + string(quantityBytes))
+		return inventoryRecord(stub, "", locationAndProduct[0], locationAndProduct[1], quantityBytes)
+	})
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get infos\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 
-	return []byte(jsonResp), nil
+	return json.Marshal(page)
 }
 
 // +-------------------------------------------------------------------------+
 // | getAllInventory - retrieve all products and quantities for all entities |
+// | Params - optional pageSize=, bookmark=                                  |
 // +-------------------------------------------------------------------------+
 func (t *SimpleChaincode) getAllInventory(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	return nil, nil
-}
+	var keyPrefix string
+	var filters map[string]string
+	var paging Paging
+	var page Page
+	var err error
+
+	filters, err = parseFilters(args, "pageSize", "bookmark")
+	if err != nil {
+		return nil, err
+	}
+	paging, err = parsePaging(filters)
+	if err != nil {
+		return nil, err
+	}
 
+	// Format InventoryByLocation##EntityId##LocationId##ProductId
+	keyPrefix = "InventoryByLocation" + SEPARATOR
+	l := len(keyPrefix)
 
-// +----------------------------------------------+
-// | read - query function to read key/value pair |
-// +----------------------------------------------+
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var key, jsonResp string
-	var err error
+	page, err = queryPage(stub, keyPrefix, paging, func(ledgerKey string, quantityBytes []byte) (json.RawMessage, error) {
+		parts := strings.SplitN(ledgerKey[l:len(ledgerKey)], SEPARATOR, 3)
+		if len(parts) != 3 {
+			return nil, newError(ERR_CORRUPTED_STATE, "Invalid inventory key "+ledgerKey)
+		}
+		return inventoryRecord(stub, parts[0], parts[1], parts[2], quantityBytes)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
+	return json.Marshal(page)
+}
+
+// +------------------------------------------------------------------------+
+// | inventoryRecord - build the inventory record of a product in a machine |
+// +------------------------------------------------------------------------+
+// Returns nil for empty locations so that the list queries skip them
+func inventoryRecord(stub shim.ChaincodeStubInterface, entityId string, locationId string, productId string, quantityBytes []byte) (json.RawMessage, error) {
+	quantity := string(quantityBytes)
+
+	q, err := strconv.Atoi(quantity)
+	if err != nil {
+		return nil, errorf(ERR_CORRUPTED_STATE, "Corrupted quantity %s of product %s at location %s of %s: %s", quantity, productId, locationId, entityId, err)
 	}
-	
-	key = args[0]
-	valAsbytes, err := stub.GetState(key)
+	if q <= 0 {
+		return nil, nil
+	}
+
+	// Read attributes from the ledger
+	product, err := getProduct(stub, productId)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 
-	return valAsbytes, nil
+	return json.Marshal(InventoryItem{EntityId: entityId, LocationId: locationId, Quantity: quantity, Product: product})
 }